@@ -0,0 +1,37 @@
+package enstore
+
+import (
+	"os"
+	"time"
+)
+
+// FileAttributes are the filesystem metadata of a file, stored with it so it can be restored as it was
+type FileAttributes struct {
+	// Mode holds the file's permission bits, and type bits such as os.ModeSymlink
+	Mode    os.FileMode
+	ModTime time.Time
+	UID     int
+	GID     int
+	// Symlink is the target of the link, if the file is a symbolic link. Links are stored with no contents.
+	Symlink string `json:",omitempty"`
+}
+
+// AttributeProvider can be implemented by a File to have its attributes stored in the index along with it.
+// Attributes may return nil if the file has none.
+type AttributeProvider interface {
+	Attributes() *FileAttributes
+}
+
+// fileAttributes returns a copy of the attributes of a File, or nil if it doesn't provide any
+func fileAttributes(file File) *FileAttributes {
+	provider, ok := file.(AttributeProvider)
+	if !ok {
+		return nil
+	}
+	attributes := provider.Attributes()
+	if attributes == nil {
+		return nil
+	}
+	copied := *attributes
+	return &copied
+}
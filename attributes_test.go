@@ -0,0 +1,48 @@
+package enstore
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// attributedFile is a testFile which provides attributes
+type attributedFile struct {
+	*testFile
+	attributes *FileAttributes
+}
+
+func (f *attributedFile) Attributes() *FileAttributes {
+	return f.attributes
+}
+
+func TestAttributes(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	link := &FileAttributes{Mode: os.ModeSymlink | 0777, ModTime: modTime, UID: 1000, GID: 1000, Symlink: "../target"}
+	script := &FileAttributes{Mode: 0755, ModTime: modTime, UID: 1000, GID: 100}
+
+	for _, dedup := range []bool{false, true} {
+		ix, store, crypter := newTestIndex(t)
+		ix.config.Dedup = dedup
+
+		// The link is added first, so it's stored with no blocks on an empty index
+		assert.Nil(t, ix.AddFile(&attributedFile{newTestFile("link", nil), link}, store, store, crypter))
+		assert.Nil(t, ix.AddFile(&attributedFile{newTestFile("script", testContents(1000)), script}, store, store, crypter))
+		assert.Nil(t, ix.AddFile(&attributedFile{newTestFile("plain", testContents(10)), nil}, store, store, crypter))
+		assert.Nil(t, ix.Save(store, crypter))
+
+		loaded, err := LoadIndex(store, crypter, ix.config)
+		assert.Nil(t, err)
+		files := make(map[string]FileMetadata)
+		for _, file := range loaded.ListFiles() {
+			files[file.Filename] = file
+		}
+		assert.Equal(t, link, files["link"].Attributes)
+		assert.Equal(t, script, files["script"].Attributes)
+		assert.Nil(t, files["plain"].Attributes)
+		assertFileContents(t, loaded, "link", []byte{}, store, crypter)
+		assertFileContents(t, loaded, "script", testContents(1000), store, crypter)
+	}
+}
@@ -1,9 +1,11 @@
 package enstore
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 )
 
 type BlockMetadata struct {
@@ -25,6 +27,22 @@ type BlockWriter interface {
 	Write(string, []byte) error
 }
 
+// BlockDeleter is implemented by BlockWriters which can remove blocks. Deleting a block which doesn't exist is not an error.
+type BlockDeleter interface {
+	Delete(string) error
+}
+
+// BlockLister is implemented by BlockReaders which can list the names of everything they contain (blocks, the index, etc.)
+type BlockLister interface {
+	List() ([]string, error)
+}
+
+// BlockRangeReader is implemented by BlockReaders which can read part of a block without reading all of it
+type BlockRangeReader interface {
+	// ReadRange reads `length` bytes of a block starting at `offset`. If the block ends first, the bytes read and io.EOF are returned.
+	ReadRange(name string, offset int64, length int) ([]byte, error)
+}
+
 func (b *Block) Update(startByte int, newBytes []byte) (int, error) {
 	if startByte >= len(b.Bytes) || startByte < 0 {
 		return 0, errors.New("start position is outside block")
@@ -45,7 +63,11 @@ func NewBlock(blockName string, blockSize int64) (*Block, error) {
 }
 
 func ReadBlock(blockName string, crypter Crypter, reader BlockReader) (*Block, error) {
-	raw, err := reader.Read(blockName)
+	return readBlock(context.Background(), blockName, crypter, reader)
+}
+
+func readBlock(ctx context.Context, blockName string, crypter Crypter, reader BlockReader) (*Block, error) {
+	raw, err := readContext(ctx, reader, blockName)
 	if err != nil {
 		return nil, err
 	}
@@ -57,11 +79,67 @@ func ReadBlock(blockName string, crypter Crypter, reader BlockReader) (*Block, e
 }
 
 func WriteBlock(block *Block, crypter Crypter, writer BlockWriter) error {
+	return writeBlock(context.Background(), block, crypter, writer)
+}
+
+func writeBlock(ctx context.Context, block *Block, crypter Crypter, writer BlockWriter) error {
 	encrypted, err := crypter.Encrypt(block.Bytes)
 	if err != nil {
 		return err
 	}
-	return writer.Write(block.Filename, encrypted)
+	return writeContext(ctx, writer, block.Filename, encrypted)
+}
+
+// ReadBlockRange reads and decrypts the bytes [start, end) of a block.
+// If the reader and crypter both support it, only the ciphertext covering the range is read, otherwise the entire block is read.
+func ReadBlockRange(blockName string, start, end int64, crypter Crypter, reader BlockReader) ([]byte, error) {
+	return readBlockRange(context.Background(), blockName, start, end, crypter, reader)
+}
+
+func readBlockRange(ctx context.Context, blockName string, start, end int64, crypter Crypter, reader BlockReader) ([]byte, error) {
+	rangeDecrypter, canDecrypt := crypter.(RangeDecrypter)
+	rangeReader, canRead := reader.(BlockRangeReader)
+	if canDecrypt && canRead {
+		return rangeDecrypter.DecryptRange(&blockReaderAt{ctx, blockName, rangeReader}, start, end)
+	}
+
+	block, err := readBlock(ctx, blockName, crypter, reader)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 || end < start || end > int64(len(block.Bytes)) {
+		return nil, errors.New("range is outside block")
+	}
+	return block.Bytes[start:end], nil
+}
+
+// blockReaderAt is an io.ReaderAt over the raw (encrypted) bytes of a block
+type blockReaderAt struct {
+	ctx    context.Context
+	name   string
+	reader BlockRangeReader
+}
+
+func (b *blockReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	data, err := readRangeContext(b.ctx, b.reader, b.name, off, len(p))
+	n := copy(p, data)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// isBlockName returns true if the name could have been generated by getNextBlockName
+func isBlockName(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
 }
 
 func getNextBlockName(currentBlock string) string {
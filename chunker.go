@@ -0,0 +1,117 @@
+package enstore
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// ErrInvalidChunkSizes is returned when the deduplication chunk sizes aren't 0 < min <= avg <= max
+var ErrInvalidChunkSizes = errors.New("deduplication chunk sizes must satisfy 0 < min <= avg <= max")
+
+// gearTable holds the random values the rolling hash adds for each byte.
+// It's generated from a fixed seed, as chunk boundaries must be the same every time the same data is chunked.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x656e73746f7265) // "enstore"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks using FastCDC, so that data inserted or removed in a file
+// only changes the chunks around it. Chunks are between min and max bytes, and usually close to avg.
+type chunker struct {
+	reader        io.Reader
+	min, avg, max int
+	// maskSmall is harder to match than maskLarge, which is used once a chunk reaches avg bytes (normalized chunking)
+	maskSmall uint64
+	maskLarge uint64
+	buf       []byte
+	eof       bool
+}
+
+func newChunker(reader io.Reader, min, avg, max int) (*chunker, error) {
+	if min <= 0 || min > avg || avg > max {
+		return nil, ErrInvalidChunkSizes
+	}
+	avgBits := bits.Len(uint(avg)) - 1
+	return &chunker{
+		reader:    reader,
+		min:       min,
+		avg:       avg,
+		max:       max,
+		maskSmall: topBits(avgBits + 1),
+		maskLarge: topBits(avgBits - 1),
+		buf:       make([]byte, 0, max),
+	}, nil
+}
+
+// topBits returns a mask of the highest n bits. The high bits of the hash depend on the most bytes, up to the last 64.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// next returns the next chunk, or io.EOF once the stream has been read
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && len(c.buf) < c.max {
+		start := len(c.buf)
+		c.buf = c.buf[:c.max]
+		n, err := io.ReadFull(c.reader, c.buf[start:])
+		c.buf = c.buf[:start+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf)
+	chunk := make([]byte, n)
+	copy(chunk, c.buf)
+	c.buf = append(c.buf[:0], c.buf[n:]...)
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,67 @@
+package enstore
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// randomContents returns `size` bytes of reproducible random content, which unlike testContents doesn't repeat
+func randomContents(size int, seed int64) []byte {
+	contents := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(contents)
+	return contents
+}
+
+func chunkAll(t *testing.T, data []byte, min, avg, max int) [][]byte {
+	c, err := newChunker(bytes.NewReader(data), min, avg, max)
+	assert.Nil(t, err)
+	chunks := make([][]byte, 0)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomContents(200000, 1)
+	chunks := chunkAll(t, data, 256, 1024, 4096)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		assert.True(t, len(chunk) <= 4096)
+		if i < len(chunks)-1 {
+			assert.True(t, len(chunk) >= 256)
+		}
+	}
+	average := len(data) / len(chunks)
+	assert.True(t, average > 512 && average < 2048, average)
+
+	// Inserting data only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:100000]...), []byte("inserted")...), data[100000:]...)
+	editedChunks := chunkAll(t, edited, 256, 1024, 4096)
+	existing := make(map[string]bool)
+	for _, chunk := range chunks {
+		existing[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range editedChunks {
+		if !existing[string(chunk)] {
+			changed++
+		}
+	}
+	assert.True(t, changed <= 3, changed)
+
+	// Empty input has no chunks, and short input is one chunk
+	assert.Equal(t, 0, len(chunkAll(t, []byte{}, 256, 1024, 4096)))
+	assert.Equal(t, [][]byte{data[:100]}, chunkAll(t, data[:100], 256, 1024, 4096))
+
+	_, err := newChunker(bytes.NewReader(data), 1024, 256, 4096)
+	assert.Equal(t, ErrInvalidChunkSizes, err)
+}
@@ -0,0 +1,180 @@
+package enstore
+
+import (
+	"context"
+	"sort"
+)
+
+// CompactResult describes the work done by Index.Compact
+type CompactResult struct {
+	FilesRewritten int
+	BlocksWritten  int
+	BlocksFreed    int
+}
+
+// Compact rewrites fragmented files, which are spread over more locations than their size needs, into contiguous allocations
+// on new blocks at the end of the chain, then unlinks blocks left empty if the writer is a BlockDeleter (see DeleteFile).
+// The most fragmented files are rewritten first, and no more than `maxBlocks` new blocks are written (zero or less for no limit),
+// so a large store can be compacted over several runs. Files which won't fit in what's left of the limit are skipped,
+// as are deduplicated files, whose chunks may be shared with other files.
+// All new blocks are written before the index changes, so a failure part way through leaves the index as it was.
+func (ix *Index) Compact(reader BlockReader, writer BlockWriter, crypter Crypter, maxBlocks int) (*CompactResult, error) {
+	return ix.CompactContext(context.Background(), reader, writer, crypter, maxBlocks)
+}
+
+// CompactContext is Compact, stopping if the context is cancelled. As with any other error, the index is left as it was if it's cancelled.
+func (ix *Index) CompactContext(ctx context.Context, reader BlockReader, writer BlockWriter, crypter Crypter, maxBlocks int) (*CompactResult, error) {
+	var result *CompactResult
+	err := ix.update(func(work *Index) error {
+		var err error
+		result, err = work.compact(ctx, reader, writer, crypter, maxBlocks)
+		return err
+	})
+	return result, err
+}
+
+func (ix *Index) compact(ctx context.Context, reader BlockReader, writer BlockWriter, crypter Crypter, maxBlocks int) (*CompactResult, error) {
+	blockSize := int64(ix.config.BlockSize)
+	result := &CompactResult{}
+
+	candidates := make([]FileMetadata, 0)
+	for _, file := range ix.files {
+		if len(file.Chunks) == 0 && fragmentation(file, blockSize) > 0 {
+			candidates = append(candidates, file)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return fragmentation(candidates[i], blockSize) > fragmentation(candidates[j], blockSize)
+	})
+
+	// Copy the candidates onto new blocks, writing each block once it's full
+	pool := newWorkerPool(ctx, ix.config.Concurrency)
+	defer pool.wait()
+	newBlocks := make([]BlockMetadata, 0)
+	rewrites := make(map[string][]BlockLocation)
+	var current *Block
+	var offset int64
+	for _, file := range candidates {
+		end := file.storedSize()
+		if current != nil {
+			end += offset
+		}
+		needed := int((end + blockSize - 1) / blockSize)
+		if current != nil {
+			needed--
+		}
+		if maxBlocks > 0 && len(newBlocks)+needed > maxBlocks {
+			continue
+		}
+
+		locations := make([]BlockLocation, 0)
+		for _, loc := range ix.blockFileLocations(file.Blocks) {
+			data, err := readBlockRange(ctx, loc.Block, loc.StartByte, loc.EndByte, crypter, reader)
+			if err != nil {
+				return result, err
+			}
+			for len(data) > 0 {
+				if current == nil {
+					current, _ = NewBlock(getNextBlockName(""), blockSize)
+					if err := ix.logWrites(ctx, []string{current.Filename}, writer, crypter); err != nil {
+						return result, err
+					}
+					newBlocks = append(newBlocks, BlockMetadata{
+						Filename: current.Filename,
+						Size:     blockSize,
+					})
+					offset = 0
+				}
+				n, _ := current.Update(int(offset), data)
+
+				// Extend the previous location if this carries straight on from it
+				if last := len(locations) - 1; last >= 0 && locations[last].Block == current.Filename && locations[last].EndByte == offset {
+					locations[last].EndByte += int64(n)
+				} else {
+					locations = append(locations, BlockLocation{
+						Block:     current.Filename,
+						StartByte: offset,
+						EndByte:   offset + int64(n),
+					})
+				}
+				offset += int64(n)
+				data = data[n:]
+
+				if offset == blockSize {
+					if err := pool.submit(writeTask(current, crypter, writer)); err != nil {
+						return result, err
+					}
+					result.BlocksWritten++
+					current = nil
+				}
+			}
+		}
+		rewrites[file.Filename] = locations
+	}
+	if current != nil {
+		if err := pool.submit(writeTask(current, crypter, writer)); err != nil {
+			return result, err
+		}
+		result.BlocksWritten++
+	}
+	if err := pool.wait(); err != nil {
+		return result, err
+	}
+	if len(rewrites) == 0 {
+		return result, nil
+	}
+
+	// Add the new blocks to the end of the chain
+	tail := ""
+	for name := ix.startBlock; name != ""; name = ix.blocks[name].Next {
+		tail = name
+	}
+	for i, blockMeta := range newBlocks {
+		if i+1 < len(newBlocks) {
+			blockMeta.Next = newBlocks[i+1].Filename
+		}
+		ix.blocks[blockMeta.Filename] = blockMeta
+	}
+	if tail == "" {
+		ix.startBlock = newBlocks[0].Filename
+	} else {
+		tailMeta := ix.blocks[tail]
+		tailMeta.Next = newBlocks[0].Filename
+		ix.blocks[tail] = tailMeta
+	}
+
+	// Move the files over to their new locations, and free the old ones
+	touched := make([]string, 0)
+	seen := make(map[string]bool)
+	for i := range ix.files {
+		locations, ok := rewrites[ix.files[i].Filename]
+		if !ok {
+			continue
+		}
+		for _, loc := range ix.files[i].Blocks {
+			ix.removeBlockAllocation(loc)
+			if !seen[loc.Block] {
+				seen[loc.Block] = true
+				touched = append(touched, loc.Block)
+			}
+		}
+		for _, loc := range locations {
+			ix.addBlockAllocations(loc.Block, []BlockLocation{loc})
+		}
+		ix.files[i].Blocks = locations
+		result.FilesRewritten++
+	}
+
+	result.BlocksFreed = ix.releaseEmptyBlocks(touched, writer)
+	return result, nil
+}
+
+// fragmentation returns how many more locations a file is spread over than it would be if it were stored contiguously.
+// A contiguous file may start part way through a block, so it can need one more location than it fills blocks.
+func fragmentation(file FileMetadata, blockSize int64) int {
+	contiguous := int((file.storedSize()+blockSize-1)/blockSize) + 1
+	if len(file.Blocks) <= contiguous {
+		return 0
+	}
+	return len(file.Blocks) - contiguous
+}
@@ -0,0 +1,81 @@
+package enstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFragmentedIndex fills the first block with small files, deletes every other one, then adds a file of `size` bytes,
+// which is split over all the gaps left behind before carrying on to the next block
+func newFragmentedIndex(t *testing.T, size int) (*Index, *testStore, Crypter, map[string][]byte) {
+	ix, store, crypter := newTestIndex(t)
+	contents := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("small-%d", i)
+		contents[name] = testContents(100 + i)[i:]
+		assert.Nil(t, ix.AddFile(newTestFile(name, contents[name]), store, store, crypter))
+	}
+	for i := 0; i < 40; i += 2 {
+		name := fmt.Sprintf("small-%d", i)
+		assert.Nil(t, ix.DeleteFile(name, store, store, crypter, false))
+		delete(contents, name)
+	}
+	contents["big"] = testContents(size)
+	assert.Nil(t, ix.AddFile(newTestFile("big", contents["big"]), store, store, crypter))
+	return ix, store, crypter, contents
+}
+
+func TestCompact(t *testing.T) {
+	ix, store, crypter, contents := newFragmentedIndex(t, 3000)
+	assert.Equal(t, 22, len(ix.fileMap["big"].Blocks))
+	oldBlocks := []string{ix.startBlock, ix.blocks[ix.startBlock].Next}
+
+	result, err := ix.Compact(store, store, crypter, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactResult{FilesRewritten: 1, BlocksWritten: 1, BlocksFreed: 1}, *result)
+	assert.Equal(t, 1, len(ix.fileMap["big"].Blocks))
+	assert.Equal(t, 2, len(ix.blocks))
+	assert.Equal(t, oldBlocks[0], ix.startBlock)
+	assert.Equal(t, ix.fileMap["big"].Blocks[0].Block, ix.blocks[ix.startBlock].Next)
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.False(t, store.Exists(oldBlocks[1]))
+	for name, expected := range contents {
+		assertFileContents(t, ix, name, expected, store, crypter)
+	}
+
+	// The freed space is reused, and nothing is left to compact
+	assert.Nil(t, ix.AddFile(newTestFile("gap", testContents(100)), store, store, crypter))
+	assert.Equal(t, oldBlocks[0], ix.fileMap["gap"].Blocks[0].Block)
+	result, err = ix.Compact(store, store, crypter, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactResult{}, *result)
+
+	// Compaction survives saving and loading the index
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	for name, expected := range contents {
+		assertFileContents(t, loaded, name, expected, store, crypter)
+	}
+}
+
+func TestCompactMaxBlocks(t *testing.T) {
+	ix, store, crypter, contents := newFragmentedIndex(t, 5000)
+	locations := len(ix.fileMap["big"].Blocks)
+
+	// The file needs two new blocks
+	result, err := ix.Compact(store, store, crypter, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactResult{}, *result)
+	assert.Equal(t, locations, len(ix.fileMap["big"].Blocks))
+
+	result, err = ix.Compact(store, store, crypter, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactResult{FilesRewritten: 1, BlocksWritten: 2, BlocksFreed: 1}, *result)
+	assert.Equal(t, 2, len(ix.fileMap["big"].Blocks))
+	for name, expected := range contents {
+		assertFileContents(t, ix, name, expected, store, crypter)
+	}
+}
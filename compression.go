@@ -0,0 +1,183 @@
+package enstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// CompressionGzip compresses files with gzip
+const CompressionGzip string = "gzip"
+
+// compressionSampleSize is how much of a file is compressed to check whether it's worth compressing the rest
+const compressionSampleSize int = 65536
+
+// ErrUnsupportedCompression is returned for a compression algorithm enstore doesn't support
+var ErrUnsupportedCompression = errors.New("unsupported compression algorithm")
+
+// compressFile compresses a file's contents with `algorithm`, returning what should be stored for the file and whether it's compressed.
+// If the start of the file doesn't compress by at least 5%, the file is treated as incompressible and its original contents are streamed.
+// Otherwise the file is compressed into a spool, along with a copy of its original contents, which are stored instead
+// if the whole file turns out not to compress after all. The returned file must be closed once it's been read, to remove the spools.
+func compressFile(file File, algorithm string) (*storedFile, bool, error) {
+	size := file.Size()
+	sample := make([]byte, compressionSampleSize)
+	if size < int64(len(sample)) {
+		sample = sample[:size]
+	}
+	if _, err := io.ReadFull(file, sample); err != nil {
+		return nil, false, err
+	}
+	raw := io.MultiReader(bytes.NewReader(sample), io.LimitReader(file, size-int64(len(sample))))
+
+	compressed := &bytes.Buffer{}
+	if err := compress(algorithm, compressed, bytes.NewReader(sample)); err != nil {
+		return nil, false, err
+	}
+	if compressed.Len()*20 > len(sample)*19 {
+		return &storedFile{Reader: raw, name: file.Name(), size: size}, false, nil
+	}
+	if int64(len(sample)) == size {
+		return &storedFile{Reader: compressed, name: file.Name(), size: int64(compressed.Len())}, true, nil
+	}
+
+	compressedSpool, rawSpool := &spool{}, &spool{}
+	stored := &storedFile{name: file.Name(), spools: []*spool{compressedSpool, rawSpool}}
+	if err := compress(algorithm, compressedSpool, io.TeeReader(raw, rawSpool)); err != nil {
+		stored.Close()
+		return nil, false, err
+	}
+	if rawSpool.size != size {
+		stored.Close()
+		return nil, false, fmt.Errorf("expected to read %d bytes from file, only read %d bytes", size, rawSpool.size)
+	}
+	if compressedSpool.size >= size {
+		stored.Reader, stored.size = rawSpool.reader(), size
+		return stored, false, nil
+	}
+	stored.Reader, stored.size = compressedSpool.reader(), compressedSpool.size
+	return stored, true, nil
+}
+
+// compress writes everything read from `source` to `destination`, compressed with `algorithm`
+func compress(algorithm string, destination io.Writer, source io.Reader) error {
+	if algorithm != CompressionGzip {
+		return ErrUnsupportedCompression
+	}
+	writer := gzip.NewWriter(destination)
+	if _, err := io.Copy(writer, source); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// spoolMemorySize is how many bytes a spool holds in memory before moving them to a temporary file (1 MiB)
+const spoolMemorySize int = 1048576
+
+// spool collects the bytes written to it so they can be read back, in memory while there are few of them, and otherwise in a temporary file
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > spoolMemorySize {
+		file, err := ioutil.TempFile("", "enstore-spool")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := file.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns a reader for everything written to the spool
+func (s *spool) reader() io.Reader {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes())
+	}
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+// Close removes the spool's temporary file, if it has one
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+// newDecompressor returns a reader which decompresses `source` with `algorithm`
+func newDecompressor(algorithm string, source io.Reader) (io.ReadCloser, error) {
+	if algorithm != CompressionGzip {
+		return nil, ErrUnsupportedCompression
+	}
+	return gzip.NewReader(source)
+}
+
+// storedFile is a File whose contents have been replaced by what will be stored for it
+type storedFile struct {
+	io.Reader
+	name   string
+	size   int64
+	spools []*spool
+}
+
+// Close removes any spools the stored contents are read from
+func (f *storedFile) Close() error {
+	var err error
+	for _, s := range f.spools {
+		if closeErr := s.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (f *storedFile) Name() string {
+	return f.name
+}
+
+func (f *storedFile) Size() int64 {
+	return f.size
+}
+
+// decompressingReader decompresses a file as it's read from the store
+type decompressingReader struct {
+	io.ReadCloser
+	stored io.Closer
+}
+
+func (d *decompressingReader) Close() error {
+	d.ReadCloser.Close()
+	return d.stored.Close()
+}
+
+// storedSize returns the number of bytes stored for a file, which is less than its size if it's compressed
+func (f *FileMetadata) storedSize() int64 {
+	if f.Compression != "" {
+		return f.StoredSize
+	}
+	return f.Size
+}
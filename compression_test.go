@@ -0,0 +1,124 @@
+package enstore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Compression = CompressionGzip
+	files := map[string][]byte{
+		"large":          testContents(200000),
+		"small":          testContents(3000),
+		"incompressible": randomContents(100000, 1),
+		"empty":          {},
+	}
+	for _, name := range []string{"large", "small", "incompressible", "empty"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, files[name]), store, store, crypter))
+	}
+
+	for _, name := range []string{"large", "small"} {
+		fileMeta := ix.fileMap[name]
+		assert.Equal(t, CompressionGzip, fileMeta.Compression, name)
+		assert.Equal(t, int64(len(files[name])), fileMeta.Size, name)
+		assert.True(t, fileMeta.StoredSize < fileMeta.Size/2, name)
+	}
+	assert.Equal(t, "", ix.fileMap["incompressible"].Compression)
+	assert.Equal(t, int64(len(files["incompressible"])), allocatedBytes(ix)-ix.fileMap["large"].StoredSize-ix.fileMap["small"].StoredSize)
+
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	for name, contents := range files {
+		assertFileContents(t, loaded, name, contents, store, crypter)
+	}
+
+	ix.config.Compression = "lz4"
+	assert.Equal(t, ErrUnsupportedCompression, ix.AddFile(newTestFile("unsupported", files["small"]), store, store, crypter))
+}
+
+func TestOpenCompressed(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Compression = CompressionGzip
+	contents := testContents(100000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", contents), store, store, crypter))
+
+	file, err := ix.Open("a", store, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(contents)), file.Size())
+
+	// Forwards, backwards, and past the end
+	for _, off := range []int64{50000, 60000, 10, 99990} {
+		buf := make([]byte, 100)
+		n, err := file.ReadAt(buf, off)
+		end := off + 100
+		if end > int64(len(contents)) {
+			end = int64(len(contents))
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, contents[off:end], buf[:n])
+	}
+	_, err = file.ReadAt(make([]byte, 1), 100001)
+	assert.Equal(t, io.EOF, err)
+
+	offset, err := file.Seek(-10, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(contents)-10), offset)
+	rest, err := io.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, contents[len(contents)-10:], rest)
+}
+
+func TestCompressionSpool(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Compression = CompressionGzip
+	ix.config.BlockSize = 65536
+
+	// Compressed contents too large to keep in memory are spooled to a temporary file, which is removed once they're stored
+	contents := randomContents(spoolMemorySize*3, 1)
+	for i := 0; i < len(contents); i += 4 {
+		contents[i], contents[i+1], contents[i+2] = 0, 0, 0
+	}
+	temps, _ := filepath.Glob(filepath.Join(os.TempDir(), "enstore-spool*"))
+	assert.Nil(t, ix.AddFile(newTestFile("a", contents), store, store, crypter))
+	fileMeta := ix.fileMap["a"]
+	assert.Equal(t, CompressionGzip, fileMeta.Compression)
+	assert.True(t, fileMeta.StoredSize > int64(spoolMemorySize))
+	assert.True(t, fileMeta.StoredSize < fileMeta.Size)
+	assertFileContents(t, ix, "a", contents, store, crypter)
+	after, _ := filepath.Glob(filepath.Join(os.TempDir(), "enstore-spool*"))
+	assert.Equal(t, temps, after)
+}
+
+func TestSpool(t *testing.T) {
+	for _, size := range []int{100, spoolMemorySize + 1} {
+		s := &spool{}
+		contents := testContents(size)
+		n, err := s.Write(contents[:size/2])
+		assert.Nil(t, err)
+		assert.Equal(t, size/2, n)
+		_, err = s.Write(contents[size/2:])
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), s.size)
+		assert.Equal(t, size > spoolMemorySize, s.file != nil)
+
+		read, err := ioutil.ReadAll(s.reader())
+		assert.Nil(t, err)
+		assert.Equal(t, contents, read)
+		if s.file != nil {
+			name := s.file.Name()
+			assert.Nil(t, s.Close())
+			_, err = os.Stat(name)
+			assert.True(t, os.IsNotExist(err))
+		}
+		assert.Nil(t, s.Close())
+	}
+}
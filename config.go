@@ -9,20 +9,61 @@ const (
 	DefaultChunkSize int = 512 // 512 bytes
 	// DefaultIndexfile is the default index file path
 	DefaultIndexfile string = "index"
+	// DefaultHeaderfile is the default store header file path
+	DefaultHeaderfile string = "header"
+	// DefaultJournalfile is the default journal file path
+	DefaultJournalfile string = "journal"
+	// DefaultLockfile is the default store lock file path
+	DefaultLockfile string = "lock"
+	// DefaultDedupMinSize is the default smallest deduplication chunk (16 KB)
+	DefaultDedupMinSize int = 16384
+	// DefaultDedupAvgSize is the default target deduplication chunk size (64 KB)
+	DefaultDedupAvgSize int = 65536
+	// DefaultDedupMaxSize is the default largest deduplication chunk (256 KB)
+	DefaultDedupMaxSize int = 262144
+	// DefaultConcurrency is the default number of blocks read or written at once
+	DefaultConcurrency int = 4
 )
 
 // Config is the basic configuration for enstore
 type Config struct {
-	BlockSize int
-	ChunkSize int
-	IndexFile string
+	BlockSize  int
+	ChunkSize  int
+	IndexFile  string
+	HeaderFile string
+	// JournalFile records the blocks written by changes which haven't been committed by saving the index yet
+	JournalFile string
+	// LockFile is the lock taken by LockStore while a process changes the store
+	LockFile string
+	// KDF are the key derivation parameters used when creating a new store header
+	KDF KDFParams
+	// Dedup splits files added to the store into content-defined chunks between DedupMinSize and DedupMaxSize bytes,
+	// and only stores chunks which aren't already in the store
+	Dedup        bool
+	DedupMinSize int
+	DedupAvgSize int
+	DedupMaxSize int
+	// Compression is the algorithm files are compressed with before they're written (CompressionGzip), or empty for none.
+	// Deduplicated files aren't compressed.
+	Compression string
+	// Concurrency is how many blocks are read and decrypted, or encrypted and written, at once.
+	// Files are still read in order; up to Concurrency sections of a file are fetched ahead of the one being read. 1 does everything in turn.
+	Concurrency int
 }
 
 // NewDefaultConfig returns a pointer to a new Config with default values
 func NewDefaultConfig() *Config {
 	return &Config{
-		BlockSize: DefaultBlockSize,
-		ChunkSize: DefaultChunkSize,
-		IndexFile: DefaultIndexfile,
+		BlockSize:    DefaultBlockSize,
+		ChunkSize:    DefaultChunkSize,
+		IndexFile:    DefaultIndexfile,
+		HeaderFile:   DefaultHeaderfile,
+		JournalFile:  DefaultJournalfile,
+		LockFile:     DefaultLockfile,
+		KDF:          DefaultKDFParams(),
+		DedupMinSize: DefaultDedupMinSize,
+		DedupAvgSize: DefaultDedupAvgSize,
+		DedupMaxSize: DefaultDedupMaxSize,
+		Concurrency:  DefaultConcurrency,
 	}
 }
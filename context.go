@@ -0,0 +1,109 @@
+package enstore
+
+import "context"
+
+// ContextBlockReader is implemented by BlockReaders whose reads can be cancelled, or time out, with a context
+type ContextBlockReader interface {
+	BlockReader
+	ReadContext(ctx context.Context, name string) ([]byte, error)
+}
+
+// ContextBlockRangeReader is implemented by BlockRangeReaders whose range reads can be cancelled with a context
+type ContextBlockRangeReader interface {
+	BlockRangeReader
+	ReadRangeContext(ctx context.Context, name string, offset int64, length int) ([]byte, error)
+}
+
+// ContextBlockWriter is implemented by BlockWriters whose writes can be cancelled, or time out, with a context
+type ContextBlockWriter interface {
+	BlockWriter
+	WriteContext(ctx context.Context, name string, data []byte) error
+}
+
+// ContextReader returns a ContextBlockReader for any BlockReader. If the reader doesn't take a context itself,
+// the context is checked before each read, so once it's cancelled no more blocks are read, but a read which has started runs to completion.
+// If the reader is a BlockRangeReader, so is the returned reader.
+func ContextReader(reader BlockReader) ContextBlockReader {
+	if contextReader, ok := reader.(ContextBlockReader); ok {
+		if _, ok := reader.(BlockRangeReader); !ok {
+			return contextReader
+		}
+		if _, ok := reader.(ContextBlockRangeReader); ok {
+			return contextReader
+		}
+	}
+	if _, ok := reader.(BlockRangeReader); ok {
+		return &contextRangeReaderAdapter{contextReaderAdapter{reader}}
+	}
+	return &contextReaderAdapter{reader}
+}
+
+// ContextWriter returns a ContextBlockWriter for any BlockWriter. If the writer doesn't take a context itself,
+// the context is checked before each write, so once it's cancelled no more blocks are written, but a write which has started runs to completion.
+func ContextWriter(writer BlockWriter) ContextBlockWriter {
+	if contextWriter, ok := writer.(ContextBlockWriter); ok {
+		return contextWriter
+	}
+	return &contextWriterAdapter{writer}
+}
+
+type contextReaderAdapter struct {
+	BlockReader
+}
+
+func (r *contextReaderAdapter) ReadContext(ctx context.Context, name string) ([]byte, error) {
+	return readContext(ctx, r.BlockReader, name)
+}
+
+type contextRangeReaderAdapter struct {
+	contextReaderAdapter
+}
+
+func (r *contextRangeReaderAdapter) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	return r.BlockReader.(BlockRangeReader).ReadRange(name, offset, length)
+}
+
+func (r *contextRangeReaderAdapter) ReadRangeContext(ctx context.Context, name string, offset int64, length int) ([]byte, error) {
+	return readRangeContext(ctx, r.BlockReader.(BlockRangeReader), name, offset, length)
+}
+
+type contextWriterAdapter struct {
+	BlockWriter
+}
+
+func (w *contextWriterAdapter) WriteContext(ctx context.Context, name string, data []byte) error {
+	return writeContext(ctx, w.BlockWriter, name, data)
+}
+
+// readContext reads a block with the context if the reader supports it, or otherwise as long as the context isn't done
+func readContext(ctx context.Context, reader BlockReader, name string) ([]byte, error) {
+	if contextReader, ok := reader.(ContextBlockReader); ok {
+		return contextReader.ReadContext(ctx, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return reader.Read(name)
+}
+
+// readRangeContext reads part of a block with the context if the reader supports it, or otherwise as long as the context isn't done
+func readRangeContext(ctx context.Context, reader BlockRangeReader, name string, offset int64, length int) ([]byte, error) {
+	if contextReader, ok := reader.(ContextBlockRangeReader); ok {
+		return contextReader.ReadRangeContext(ctx, name, offset, length)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return reader.ReadRange(name, offset, length)
+}
+
+// writeContext writes a block with the context if the writer supports it, or otherwise as long as the context isn't done
+func writeContext(ctx context.Context, writer BlockWriter, name string, data []byte) error {
+	if contextWriter, ok := writer.(ContextBlockWriter); ok {
+		return contextWriter.WriteContext(ctx, name, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return writer.Write(name, data)
+}
@@ -0,0 +1,146 @@
+package enstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cancellingStore is a testStore which cancels a context once it's written `writes` blocks
+type cancellingStore struct {
+	*testStore
+	cancel context.CancelFunc
+	writes int
+}
+
+func (s *cancellingStore) Write(name string, data []byte) error {
+	if isBlockName(name) {
+		s.writes--
+		if s.writes == 0 {
+			s.cancel()
+		}
+	}
+	return s.testStore.Write(name, data)
+}
+
+func TestContextAdapters(t *testing.T) {
+	store := newTestStore()
+	reader := ContextReader(store)
+	writer := ContextWriter(store)
+	_, isRangeReader := reader.(ContextBlockRangeReader)
+	assert.True(t, isRangeReader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, writer.WriteContext(ctx, "a", []byte("abc")))
+	data, err := reader.ReadContext(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), data)
+
+	cancel()
+	assert.Equal(t, context.Canceled, writer.WriteContext(ctx, "b", []byte("abc")))
+	_, err = reader.ReadContext(ctx, "a")
+	assert.Equal(t, context.Canceled, err)
+	_, err = reader.(ContextBlockRangeReader).ReadRangeContext(ctx, "a", 0, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, store.Exists("b"))
+
+	// Readers which take a context themselves aren't wrapped
+	s3 := newTestS3ReadWriter(t, "http://localhost")
+	assert.Equal(t, s3, ContextReader(s3))
+	assert.Equal(t, s3, ContextWriter(s3))
+}
+
+func TestContextCancelled(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	contents := randomContents(40000, 1)
+	assert.Nil(t, ix.AddFile(newTestFile("a", contents), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	file, err := ix.GetFileReaderContext(ctx, "a", store, crypter)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(file)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, file.Close())
+	assert.Equal(t, context.Canceled, ix.GetFileContext(ctx, "a", ioutil.Discard, store, crypter))
+	_, err = LoadIndexContext(ctx, store, crypter, ix.config)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, ix.SaveContext(ctx, store, crypter))
+
+	// A cancelled add stops writing blocks, and leaves the file out of the index
+	ix.config.Concurrency = 1
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cancelling := &cancellingStore{testStore: store, cancel: cancel, writes: 2}
+	err = ix.AddFileContext(ctx, newTestFile("b", randomContents(40000, 2)), cancelling, cancelling, crypter)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"a"}, fileNames(ix))
+	assert.Equal(t, 0, cancelling.writes)
+}
+
+func TestIndexMethodsContextCancelled(t *testing.T) {
+	ix, store, crypter, contents := newFragmentedIndex(t, 3000)
+	assert.Nil(t, ix.Snapshot("before", store, crypter))
+	blocks := len(ix.fileMap["big"].Blocks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ix.CompactContext(ctx, store, store, crypter, 0)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, blocks, len(ix.fileMap["big"].Blocks))
+	results, err := ix.VerifyContext(ctx, nil, store, crypter)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(results))
+	_, err = ix.GCContext(ctx, store, store, false)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, ix.SnapshotContext(ctx, "after", store, crypter))
+	assert.Equal(t, 1, len(ix.ListSnapshots()))
+	assert.Equal(t, context.Canceled, ix.RestoreSnapshotContext(ctx, "before", store, crypter))
+	_, err = LoadIndexAtContext(ctx, store, crypter, ix.config, "before")
+	assert.Equal(t, context.Canceled, err)
+
+	file, err := ix.OpenContext(ctx, "big", store, crypter)
+	assert.Nil(t, err)
+	_, err = file.ReadAt(make([]byte, 10), 0)
+	assert.Equal(t, context.Canceled, err)
+
+	// Nothing was changed
+	for name, data := range contents {
+		assertFileContents(t, ix, name, data, store, crypter)
+	}
+}
+
+func TestBackendContext(t *testing.T) {
+	// The request is abandoned when the context times out, rather than waiting for the server
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s3 := newTestS3ReadWriter(t, server.URL)
+	webdav, err := NewWebDAVReadWriter(WebDAVConfig{URL: server.URL})
+	assert.Nil(t, err)
+	for _, backend := range []interface {
+		ContextBlockReader
+		ContextBlockWriter
+	}{s3, webdav} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := backend.ReadContext(ctx, "a")
+		assert.NotNil(t, err)
+		assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+		cancel()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		assert.NotNil(t, backend.WriteContext(ctx, "a", []byte("abc")))
+		cancel()
+	}
+}
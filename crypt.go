@@ -4,8 +4,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // AESCrypter is a struct that can encrypt and decypt bytes using AES and a common key
@@ -178,3 +181,413 @@ func (d *AESDecryptionReader) Read(p []byte) (int, error) {
 	}
 	return 0, io.EOF
 }
+
+// Algorithm identifies the AEAD cipher used to produce a ciphertext
+type Algorithm byte
+
+const (
+	// AlgorithmAESGCM is AES in Galois/Counter Mode (AES-128, -192 or -256 depending on the key length)
+	AlgorithmAESGCM Algorithm = 1
+	// AlgorithmXChaCha20Poly1305 is XChaCha20-Poly1305, which requires a 32-byte key
+	AlgorithmXChaCha20Poly1305 Algorithm = 2
+)
+
+const (
+	// cipherVersion1 is a single AEAD seal of the whole plaintext: header | nonce | sealed
+	cipherVersion1 byte = 1
+	// cipherVersion2 seals the plaintext in fixed-size segments, so ranges can be decrypted on their own:
+	// header | segment size | plaintext length | nonce | sealed segments
+	cipherVersion2 byte = 2
+	// cipherHeaderSize is the length of the magic, version and algorithm bytes
+	cipherHeaderSize = 6
+	// segmentedHeaderSize is the length of the version 2 header, excluding the nonce
+	segmentedHeaderSize = cipherHeaderSize + 4 + 8
+	// maxNonceSize is the largest nonce used by any Algorithm (XChaCha20-Poly1305)
+	maxNonceSize = 24
+	// DefaultSegmentSize is the default plaintext size of each segment of version 2 ciphertext (64 KiB)
+	DefaultSegmentSize int = 65536
+)
+
+// cipherMagic prefixes all versioned ciphertext, and distinguishes it from legacy (header-less) AES-CFB ciphertext
+var cipherMagic = []byte("ENSC")
+
+var (
+	// ErrAuthenticationFailed is returned when ciphertext fails authentication, meaning it is corrupt or has been tampered with
+	ErrAuthenticationFailed = errors.New("ciphertext failed authentication")
+	// ErrUnsupportedAlgorithm is returned when a ciphertext header or crypter names an unknown algorithm
+	ErrUnsupportedAlgorithm = errors.New("unsupported encryption algorithm")
+	// ErrUnsupportedVersion is returned when a ciphertext header has an unknown version
+	ErrUnsupportedVersion = errors.New("unsupported ciphertext version")
+	// ErrMissingHeader is returned when header-less ciphertext is decrypted by a crypter which doesn't allow legacy ciphertext
+	ErrMissingHeader = errors.New("ciphertext has no header")
+	// ErrRangeOutOfBounds is returned when a range to decrypt extends past the end of the plaintext
+	ErrRangeOutOfBounds = errors.New("range is outside ciphertext")
+)
+
+// RangeDecrypter is implemented by Crypters which can decrypt part of a ciphertext without reading or decrypting all of it
+type RangeDecrypter interface {
+	// DecryptRange returns the plaintext bytes [start, end) of the ciphertext read from `source`
+	DecryptRange(source io.ReaderAt, start, end int64) ([]byte, error)
+	// SegmentSize returns the size of the ranges it's efficient to decrypt, as each one decrypted costs about as much as a whole segment
+	SegmentSize() int
+}
+
+// DecryptRange decrypts the plaintext bytes [start, end) of the ciphertext read from `source`.
+// Each CFB block only depends on its own ciphertext and the previous ciphertext block (or the IV),
+// so only the ciphertext blocks covering the range and the one before them are read.
+func (a *AESCrypter) DecryptRange(source io.ReaderAt, start, end int64) ([]byte, error) {
+	if start < 0 || end < start {
+		return nil, ErrRangeOutOfBounds
+	}
+	block, err := aes.NewCipher(a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plaintext byte N is at ciphertext byte N+BlockSize, so the block preceeding an aligned plaintext offset starts at that offset
+	aligned := start - start%aes.BlockSize
+	buf := make([]byte, aes.BlockSize+end-aligned)
+	n, err := source.ReadAt(buf, aligned)
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = ErrRangeOutOfBounds
+		}
+		return nil, err
+	}
+
+	stream := cipher.NewCFBDecrypter(block, buf[:aes.BlockSize])
+	stream.XORKeyStream(buf[aes.BlockSize:], buf[aes.BlockSize:])
+	return buf[aes.BlockSize+start-aligned:], nil
+}
+
+// SegmentSize returns DefaultSegmentSize. CFB ciphertext can be decrypted from any offset, so that's only a reasonable size to read at once.
+func (a *AESCrypter) SegmentSize() int {
+	return DefaultSegmentSize
+}
+
+// AEADCrypter is a Crypter which uses authenticated encryption, so any modification of the ciphertext is detected on decryption.
+// Ciphertext is prefixed with a header identifying the format version and algorithm, so stores may contain data written
+// with different algorithms. If allowed, header-less ciphertext is treated as legacy AES-CFB written by an AESCrypter with the same key.
+type AEADCrypter struct {
+	key         []byte
+	algorithm   Algorithm
+	legacy      *AESCrypter
+	segmentSize int
+}
+
+// NewAEADCrypter creates a new AEADCrypter which encrypts using `algorithm` and the provided key.
+// If `allowLegacy` is true, ciphertext without a header will be decrypted as AES-CFB, for reading stores written by an AESCrypter.
+func NewAEADCrypter(key []byte, algorithm Algorithm, allowLegacy bool) (*AEADCrypter, error) {
+	if _, err := newAEAD(algorithm, key); err != nil {
+		return nil, err
+	}
+	crypter := &AEADCrypter{
+		key:         key,
+		algorithm:   algorithm,
+		segmentSize: DefaultSegmentSize,
+	}
+	if allowLegacy {
+		legacy, err := NewAESCrypter(key)
+		if err != nil {
+			return nil, err
+		}
+		crypter.legacy = legacy
+	}
+	return crypter, nil
+}
+
+// Algorithm returns the algorithm the AEADCrypter encrypts with
+func (a *AEADCrypter) Algorithm() Algorithm {
+	return a.algorithm
+}
+
+// SegmentSize returns the plaintext size of each segment of the ciphertext the AEADCrypter writes
+func (a *AEADCrypter) SegmentSize() int {
+	return a.segmentSize
+}
+
+// Encrypt encrypts and authenticates the bytes passed to it.
+// The plaintext is sealed in segments, so that ranges of it can later be decrypted with DecryptRange.
+func (a *AEADCrypter) Encrypt(bytes []byte) ([]byte, error) {
+	aead, err := newAEAD(a.algorithm, a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, segmentedHeaderSize+aead.NonceSize())
+	copy(header, cipherMagic)
+	header[len(cipherMagic)] = cipherVersion2
+	header[len(cipherMagic)+1] = byte(a.algorithm)
+	binary.BigEndian.PutUint32(header[cipherHeaderSize:], uint32(a.segmentSize))
+	binary.BigEndian.PutUint64(header[cipherHeaderSize+4:], uint64(len(bytes)))
+	if _, err := io.ReadFull(rand.Reader, header[segmentedHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	segments := &segmentedCipher{
+		aead:        aead,
+		header:      header,
+		segmentSize: int64(a.segmentSize),
+		plainLength: int64(len(bytes)),
+	}
+	cipherText := make([]byte, len(header), segments.cipherLength())
+	copy(cipherText, header)
+	for i := int64(0); i < segments.count(); i++ {
+		start, end := segments.plainRange(i)
+		// The header is authenticated as additional data, so the version, algorithm and lengths can't be altered either
+		cipherText = aead.Seal(cipherText, segments.nonce(i), bytes[start:end], header)
+	}
+	return cipherText, nil
+}
+
+// Decrypt authenticates and decrypts the bytes passed to it
+func (a *AEADCrypter) Decrypt(bytes []byte) ([]byte, error) {
+	if !hasCipherHeader(bytes) {
+		if a.legacy == nil {
+			return nil, ErrMissingHeader
+		}
+		return a.legacy.Decrypt(bytes)
+	}
+
+	switch bytes[len(cipherMagic)] {
+	case cipherVersion1:
+		return a.decryptV1(bytes)
+	case cipherVersion2:
+		segments, err := a.parseSegmentedHeader(bytes)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(bytes)) != segments.cipherLength() {
+			return nil, ErrAuthenticationFailed
+		}
+		return segments.open(bytes[len(segments.header):], 0, segments.count())
+	}
+	return nil, ErrUnsupportedVersion
+}
+
+// DecryptRange decrypts the plaintext bytes [start, end) of the ciphertext read from `source`.
+// For segmented ciphertext, only the segments covering the range are read and authenticated.
+func (a *AEADCrypter) DecryptRange(source io.ReaderAt, start, end int64) ([]byte, error) {
+	if start < 0 || end < start {
+		return nil, ErrRangeOutOfBounds
+	}
+
+	prefix := make([]byte, segmentedHeaderSize+maxNonceSize)
+	n, err := source.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	prefix = prefix[:n]
+
+	if !hasCipherHeader(prefix) {
+		if a.legacy == nil {
+			return nil, ErrMissingHeader
+		}
+		return a.legacy.DecryptRange(source, start, end)
+	}
+
+	switch prefix[len(cipherMagic)] {
+	case cipherVersion1:
+		// Version 1 is sealed as a whole, so all of it has to be authenticated
+		all, err := readAllAt(source)
+		if err != nil {
+			return nil, err
+		}
+		plainText, err := a.decryptV1(all)
+		if err != nil {
+			return nil, err
+		}
+		if end > int64(len(plainText)) {
+			return nil, ErrRangeOutOfBounds
+		}
+		return plainText[start:end], nil
+	case cipherVersion2:
+		segments, err := a.parseSegmentedHeader(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if end > segments.plainLength {
+			return nil, ErrRangeOutOfBounds
+		}
+		if start == end {
+			return []byte{}, nil
+		}
+
+		first, last := start/segments.segmentSize, (end-1)/segments.segmentSize
+		cipherStart, _ := segments.cipherRange(first)
+		_, cipherEnd := segments.cipherRange(last)
+		sealed := make([]byte, cipherEnd-cipherStart)
+		n, err := source.ReadAt(sealed, cipherStart)
+		if n < len(sealed) {
+			if err == nil || err == io.EOF {
+				err = ErrAuthenticationFailed
+			}
+			return nil, err
+		}
+		plainText, err := segments.open(sealed, first, last+1)
+		if err != nil {
+			return nil, err
+		}
+		offset := first * segments.segmentSize
+		return plainText[start-offset : end-offset], nil
+	}
+	return nil, ErrUnsupportedVersion
+}
+
+// decryptV1 decrypts version 1 ciphertext, which is header | nonce | sealed
+func (a *AEADCrypter) decryptV1(bytes []byte) ([]byte, error) {
+	header := bytes[:cipherHeaderSize]
+	aead, err := newAEAD(Algorithm(header[len(cipherMagic)+1]), a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) < cipherHeaderSize+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("text is too short")
+	}
+	nonce := bytes[cipherHeaderSize : cipherHeaderSize+aead.NonceSize()]
+	sealed := bytes[cipherHeaderSize+aead.NonceSize():]
+
+	plainText, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return plainText, nil
+}
+
+// parseSegmentedHeader reads the version 2 header from the start of `bytes`
+func (a *AEADCrypter) parseSegmentedHeader(bytes []byte) (*segmentedCipher, error) {
+	if len(bytes) < segmentedHeaderSize {
+		return nil, errors.New("text is too short")
+	}
+	aead, err := newAEAD(Algorithm(bytes[len(cipherMagic)+1]), a.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) < segmentedHeaderSize+aead.NonceSize() {
+		return nil, errors.New("text is too short")
+	}
+
+	segments := &segmentedCipher{
+		aead:        aead,
+		header:      bytes[:segmentedHeaderSize+aead.NonceSize()],
+		segmentSize: int64(binary.BigEndian.Uint32(bytes[cipherHeaderSize:])),
+		plainLength: int64(binary.BigEndian.Uint64(bytes[cipherHeaderSize+4:])),
+	}
+	if segments.segmentSize <= 0 || segments.plainLength < 0 {
+		return nil, ErrAuthenticationFailed
+	}
+	return segments, nil
+}
+
+// segmentedCipher describes the layout of version 2 ciphertext
+type segmentedCipher struct {
+	aead        cipher.AEAD
+	header      []byte
+	segmentSize int64
+	plainLength int64
+}
+
+// count returns the number of segments. Empty plaintext is still sealed as a single (empty) segment.
+func (s *segmentedCipher) count() int64 {
+	if s.plainLength == 0 {
+		return 1
+	}
+	return (s.plainLength + s.segmentSize - 1) / s.segmentSize
+}
+
+// cipherLength returns the total length of the ciphertext, including the header
+func (s *segmentedCipher) cipherLength() int64 {
+	return int64(len(s.header)) + s.plainLength + s.count()*int64(s.aead.Overhead())
+}
+
+// plainRange returns the range of plaintext bytes sealed in segment `i`
+func (s *segmentedCipher) plainRange(i int64) (int64, int64) {
+	start := i * s.segmentSize
+	end := start + s.segmentSize
+	if end > s.plainLength {
+		end = s.plainLength
+	}
+	return start, end
+}
+
+// cipherRange returns the range of ciphertext bytes containing segment `i`
+func (s *segmentedCipher) cipherRange(i int64) (int64, int64) {
+	start, end := s.plainRange(i)
+	overhead := int64(s.aead.Overhead())
+	return int64(len(s.header)) + start + i*overhead, int64(len(s.header)) + end + (i+1)*overhead
+}
+
+// nonce returns the nonce for segment `i`, which is the header nonce with the segment number XORed into its last bytes
+func (s *segmentedCipher) nonce(i int64) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.header[segmentedHeaderSize:])
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(i))
+	for j := range counter {
+		nonce[len(nonce)-len(counter)+j] ^= counter[j]
+	}
+	return nonce
+}
+
+// open authenticates and decrypts the consecutive segments [first, last) contained in `sealed`
+func (s *segmentedCipher) open(sealed []byte, first, last int64) ([]byte, error) {
+	plainStart, _ := s.plainRange(first)
+	_, plainEnd := s.plainRange(last - 1)
+	plainText := make([]byte, 0, plainEnd-plainStart)
+
+	offset, _ := s.cipherRange(first)
+	for i := first; i < last; i++ {
+		start, end := s.cipherRange(i)
+		var err error
+		plainText, err = s.aead.Open(plainText, s.nonce(i), sealed[start-offset:end-offset], s.header)
+		if err != nil {
+			return nil, ErrAuthenticationFailed
+		}
+	}
+	return plainText, nil
+}
+
+// hasCipherHeader returns true if the bytes begin with the versioned ciphertext magic
+func hasCipherHeader(bytes []byte) bool {
+	if len(bytes) < cipherHeaderSize {
+		return false
+	}
+	for i, b := range cipherMagic {
+		if bytes[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// newAEAD returns the cipher.AEAD for an algorithm and key
+func newAEAD(algorithm Algorithm, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgorithmAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// readAllAt reads everything from an io.ReaderAt
+func readAllAt(source io.ReaderAt) ([]byte, error) {
+	var all []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := source.ReadAt(buf, int64(len(all)))
+		all = append(all, buf[:n]...)
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
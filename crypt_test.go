@@ -3,6 +3,8 @@ package enstore
 import (
 	"bytes"
 	"crypto/aes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"testing"
 
@@ -110,3 +112,220 @@ func TestReaders(t *testing.T) {
 
 	assert.Equal(t, content, res)
 }
+
+func TestNewAEADCrypter(t *testing.T) {
+	tests := []struct {
+		testname      string
+		key           []byte
+		algorithm     Algorithm
+		allowLegacy   bool
+		expectedError error
+	}{
+		{"AES-GCM bad key size", []byte{1, 2, 3}, AlgorithmAESGCM, false, aes.KeySizeError(3)},
+		{"XChaCha20-Poly1305 bad key size", good16ByteKey, AlgorithmXChaCha20Poly1305, false, errors.New("chacha20poly1305: bad key length")},
+		{"Unknown algorithm", good32ByteKey, Algorithm(0), false, ErrUnsupportedAlgorithm},
+		{"AES-GCM", good16ByteKey, AlgorithmAESGCM, true, nil},
+		{"XChaCha20-Poly1305", good32ByteKey, AlgorithmXChaCha20Poly1305, true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testname, func(t *testing.T) {
+			c, err := NewAEADCrypter(test.key, test.algorithm, test.allowLegacy)
+			assert.Equal(t, test.expectedError, err)
+			if test.expectedError == nil {
+				assert.Equal(t, test.algorithm, c.Algorithm())
+			}
+		})
+	}
+}
+
+func TestAEADEncryptDecrypt(t *testing.T) {
+	raw := []byte{9, 8, 7, 6, 5, 4, 3, 2, 1}
+
+	tests := []struct {
+		testname  string
+		key       []byte
+		algorithm Algorithm
+	}{
+		{"AES-128-GCM", good16ByteKey, AlgorithmAESGCM},
+		{"AES-256-GCM", good32ByteKey, AlgorithmAESGCM},
+		{"XChaCha20-Poly1305", good32ByteKey, AlgorithmXChaCha20Poly1305},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testname, func(t *testing.T) {
+			c, err := NewAEADCrypter(test.key, test.algorithm, false)
+			assert.Nil(t, err)
+
+			encrypted, err := c.Encrypt(raw)
+			assert.Nil(t, err)
+			assert.Equal(t, cipherMagic, encrypted[:len(cipherMagic)])
+			assert.Equal(t, byte(test.algorithm), encrypted[len(cipherMagic)+1])
+
+			decrypted, err := c.Decrypt(encrypted)
+			assert.Nil(t, err)
+			assert.Equal(t, raw, decrypted)
+		})
+	}
+}
+
+func TestAEADDecryptOtherAlgorithm(t *testing.T) {
+	// Ciphertext names its algorithm, so a crypter can read data written with a different algorithm and the same key
+	raw := []byte("I AM CONTENT")
+	gcm, _ := NewAEADCrypter(good32ByteKey, AlgorithmAESGCM, false)
+	xchacha, _ := NewAEADCrypter(good32ByteKey, AlgorithmXChaCha20Poly1305, false)
+
+	encrypted, err := gcm.Encrypt(raw)
+	assert.Nil(t, err)
+	decrypted, err := xchacha.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, decrypted)
+}
+
+func TestAEADDecryptErrors(t *testing.T) {
+	raw := []byte{9, 8, 7, 6, 5, 4, 3, 2, 1}
+	c, _ := NewAEADCrypter(good32ByteKey, AlgorithmAESGCM, false)
+	otherKey, _ := NewAEADCrypter(good16ByteKey, AlgorithmAESGCM, false)
+
+	tampered := func(idx int) []byte {
+		encrypted, _ := c.Encrypt(raw)
+		encrypted[idx] ^= 1
+		return encrypted
+	}
+	truncated := func(n int) []byte {
+		encrypted, _ := c.Encrypt(raw)
+		return encrypted[:len(encrypted)-n]
+	}
+	withVersion := func(version byte) []byte {
+		encrypted, _ := c.Encrypt(raw)
+		encrypted[len(cipherMagic)] = version
+		return encrypted
+	}
+	withAlgorithm := func(algorithm byte) []byte {
+		encrypted, _ := c.Encrypt(raw)
+		encrypted[len(cipherMagic)+1] = algorithm
+		return encrypted
+	}
+	wrongKey, _ := otherKey.Encrypt(raw)
+	legacy, _ := NewAESCrypter(good32ByteKey)
+	legacyEncrypted, _ := legacy.Encrypt(raw)
+
+	tests := []struct {
+		testname      string
+		toDecrypt     []byte
+		expectedError error
+	}{
+		{"Flipped segment size bit", tampered(cipherHeaderSize), ErrAuthenticationFailed},
+		{"Flipped length bit", tampered(cipherHeaderSize + 11), ErrAuthenticationFailed},
+		{"Flipped nonce bit", tampered(segmentedHeaderSize), ErrAuthenticationFailed},
+		{"Flipped ciphertext bit", tampered(segmentedHeaderSize + 12), ErrAuthenticationFailed},
+		{"Flipped tag bit", tampered(segmentedHeaderSize + 12 + len(raw) + 1), ErrAuthenticationFailed},
+		{"Dropped byte", truncated(1), ErrAuthenticationFailed},
+		{"Wrong key", wrongKey, ErrAuthenticationFailed},
+		{"Unknown version", withVersion(99), ErrUnsupportedVersion},
+		{"Unknown algorithm", withAlgorithm(99), ErrUnsupportedAlgorithm},
+		{"Altered magic", tampered(0), ErrMissingHeader},
+		{"Truncated header", withVersion(cipherVersion2)[:cipherHeaderSize+4], errors.New("text is too short")},
+		{"Legacy not allowed", legacyEncrypted, ErrMissingHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testname, func(t *testing.T) {
+			bytes, err := c.Decrypt(test.toDecrypt)
+			assert.Nil(t, bytes)
+			assert.Equal(t, test.expectedError, err)
+		})
+	}
+}
+
+func TestAEADDecryptLegacy(t *testing.T) {
+	raw := []byte{9, 8, 7, 6, 5, 4, 3, 2, 1}
+	legacy, _ := NewAESCrypter(good16ByteKey)
+	encrypted, _ := legacy.Encrypt(raw)
+
+	c, err := NewAEADCrypter(good16ByteKey, AlgorithmAESGCM, true)
+	assert.Nil(t, err)
+
+	bytes, err := c.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, bytes)
+}
+
+func TestAEADSegments(t *testing.T) {
+	c, _ := NewAEADCrypter(good32ByteKey, AlgorithmXChaCha20Poly1305, false)
+	c.segmentSize = 16
+
+	for _, size := range []int{0, 1, 15, 16, 17, 64, 100} {
+		raw := make([]byte, size)
+		for i := range raw {
+			raw[i] = byte(i)
+		}
+		encrypted, err := c.Encrypt(raw)
+		assert.Nil(t, err)
+
+		decrypted, err := c.Decrypt(encrypted)
+		assert.Nil(t, err)
+		assert.Equal(t, raw, decrypted)
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	raw := make([]byte, 100)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	aead, _ := NewAEADCrypter(good32ByteKey, AlgorithmAESGCM, true)
+	aead.segmentSize = 16
+	segmented, _ := aead.Encrypt(raw)
+	legacy, _ := NewAESCrypter(good32ByteKey)
+	cfb, _ := legacy.Encrypt(raw)
+
+	for _, encrypted := range [][]byte{segmented, cfb} {
+		tests := []struct {
+			testname      string
+			start         int64
+			end           int64
+			expectedError error
+		}{
+			{"Empty", 10, 10, nil},
+			{"Whole", 0, 100, nil},
+			{"Within a segment", 17, 20, nil},
+			{"Across segments", 5, 70, nil},
+			{"End of plaintext", 90, 100, nil},
+			{"Past end", 90, 101, ErrRangeOutOfBounds},
+			{"Negative", -1, 5, ErrRangeOutOfBounds},
+		}
+		for _, test := range tests {
+			t.Run(test.testname, func(t *testing.T) {
+				reader := &countingReaderAt{bytes.NewReader(encrypted), 0}
+				decrypted, err := aead.DecryptRange(reader, test.start, test.end)
+				assert.Equal(t, test.expectedError, err)
+				if test.expectedError == nil {
+					assert.Equal(t, raw[test.start:test.end], decrypted)
+					// Besides the header and tags, no more than a segment either side of the range should be read
+					tags := 16 * int((test.end-test.start)/16+3)
+					assert.True(t, reader.read <= int(test.end-test.start)+2*aead.segmentSize+tags+segmentedHeaderSize+maxNonceSize)
+				}
+			})
+		}
+	}
+
+	// Tampering with a segment is only detected if that segment is read
+	segmented[len(segmented)-1] ^= 1
+	_, err := aead.DecryptRange(bytes.NewReader(segmented), 0, 16)
+	assert.Nil(t, err)
+	_, err = aead.DecryptRange(bytes.NewReader(segmented), 90, 100)
+	assert.Equal(t, ErrAuthenticationFailed, err)
+}
+
+type countingReaderAt struct {
+	source io.ReaderAt
+	read   int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.source.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
@@ -0,0 +1,241 @@
+package enstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// ChunkMetadata describes a deduplicated chunk of file contents, which may be shared by any number of files
+type ChunkMetadata struct {
+	Size     int64
+	Blocks   []BlockLocation
+	RefCount int
+}
+
+// chunkID returns the key a chunk is stored under: an HMAC of its contents, so the index doesn't reveal hashes of what's stored
+func (ix *Index) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, ix.chunkKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stageDedupFile splits a file into content-defined chunks, and stores the chunks which aren't already stored with the stager.
+// The file's Blocks are the locations of its chunks in order, so it's read like any other file. Its chunks are added to the index,
+// and the metadata for the file is returned to be added once the stager has been flushed.
+func (ix *Index) stageDedupFile(file *hashingFile, attributes *FileAttributes, stager *blockStager) (FileMetadata, error) {
+	if ix.chunkKey == nil {
+		ix.chunkKey = make([]byte, 32)
+		if _, err := rand.Read(ix.chunkKey); err != nil {
+			return FileMetadata{}, err
+		}
+	}
+	chunks, err := newChunker(io.LimitReader(file, file.Size()), ix.config.DedupMinSize, ix.config.DedupAvgSize, ix.config.DedupMaxSize)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	fileMeta := FileMetadata{
+		Filename:   file.Name(),
+		Blocks:     make([]BlockLocation, 0),
+		Chunks:     make([]string, 0),
+		Attributes: attributes,
+	}
+	newChunks := make(map[string]*ChunkMetadata)
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return FileMetadata{}, err
+		}
+
+		id := ix.chunkID(data)
+		chunk, ok := ix.chunks[id]
+		if !ok {
+			chunk, ok = newChunks[id]
+		}
+		if !ok {
+			locations, err := stager.store(data)
+			if err != nil {
+				return FileMetadata{}, err
+			}
+			chunk = &ChunkMetadata{Size: int64(len(data)), Blocks: locations}
+			newChunks[id] = chunk
+		}
+		fileMeta.Chunks = append(fileMeta.Chunks, id)
+		fileMeta.Blocks = append(fileMeta.Blocks, chunk.Blocks...)
+		fileMeta.Size += chunk.Size
+	}
+	if fileMeta.Size != file.Size() {
+		return FileMetadata{}, fmt.Errorf("expected to read %d bytes from file, only read %d bytes", file.Size(), fileMeta.Size)
+	}
+	fileMeta.SHA256 = file.sum()
+
+	for id, chunk := range newChunks {
+		ix.chunks[id] = chunk
+	}
+	for _, id := range fileMeta.Chunks {
+		ix.chunks[id].RefCount++
+	}
+	return fileMeta, nil
+}
+
+// freedLocations returns the locations which would be freed by removing a file from the index.
+// For deduplicated files, these are the locations of the chunks no other file uses.
+func (ix *Index) freedLocations(fileMeta *FileMetadata) []BlockLocation {
+	if len(fileMeta.Chunks) == 0 {
+		locations := make([]BlockLocation, len(fileMeta.Blocks))
+		copy(locations, fileMeta.Blocks)
+		return locations
+	}
+
+	references := make(map[string]int)
+	for _, id := range fileMeta.Chunks {
+		references[id]++
+	}
+	locations := make([]BlockLocation, 0)
+	for id, count := range references {
+		if chunk := ix.chunks[id]; chunk.RefCount <= count {
+			locations = append(locations, chunk.Blocks...)
+		}
+	}
+	return locations
+}
+
+// releaseChunks drops a file's references to its chunks, removing chunks no other file uses
+func (ix *Index) releaseChunks(fileMeta *FileMetadata) {
+	for _, id := range fileMeta.Chunks {
+		chunk := ix.chunks[id]
+		chunk.RefCount--
+		if chunk.RefCount <= 0 {
+			delete(ix.chunks, id)
+		}
+	}
+}
+
+// blockStager allocates space for data on blocks and collects the data in memory, so each block is read and written once.
+// Space is found by moving forward through the chain, and a block has no usable space left once it's been moved past,
+// so only the current block is held in memory, and it's handed to the worker pool to be written when the stager moves on.
+type blockStager struct {
+	index   *Index
+	reader  BlockReader
+	writer  BlockWriter
+	crypter Crypter
+	ctx     context.Context
+	pool    *workerPool
+	current string
+	block   *Block
+	isNew   bool
+}
+
+func (ix *Index) newBlockStager(ctx context.Context, reader BlockReader, writer BlockWriter, crypter Crypter) *blockStager {
+	return &blockStager{
+		index:   ix,
+		reader:  reader,
+		writer:  writer,
+		crypter: crypter,
+		ctx:     ctx,
+		pool:    newWorkerPool(ctx, ix.config.Concurrency),
+	}
+}
+
+// store allocates space for data, copies it to the blocks, and returns its locations
+func (s *blockStager) store(data []byte) ([]BlockLocation, error) {
+	return s.storeFrom(bytes.NewReader(data), int64(len(data)))
+}
+
+// storeFrom allocates space for `size` bytes, reads them from `source` onto the blocks, and returns their locations
+func (s *blockStager) storeFrom(source io.Reader, size int64) ([]BlockLocation, error) {
+	ix := s.index
+	locations := make([]BlockLocation, 0)
+	for remaining := size; remaining > 0; {
+		if s.current == "" {
+			s.current = ix.startBlock
+			if s.current == "" {
+				s.current, s.isNew = ix.nextBlock("")
+				ix.startBlock = s.current
+			}
+		}
+
+		locs, spaceFound := ix.findSpaceInBlock(s.current, int(remaining))
+		if spaceFound > 0 {
+			if err := s.load(); err != nil {
+				return nil, err
+			}
+			ix.addBlockAllocations(s.current, locs)
+			for _, loc := range locs {
+				buf := make([]byte, loc.EndByte-loc.StartByte)
+				n, err := io.ReadFull(source, buf)
+				if err == io.ErrUnexpectedEOF || err == io.EOF {
+					return nil, fmt.Errorf("expected to read %d bytes from file, only read %d bytes", size, size-remaining+int64(n))
+				}
+				if err != nil {
+					return nil, err
+				}
+				s.block.Update(int(loc.StartByte), buf)
+				remaining -= int64(n)
+			}
+			locations = append(locations, locs...)
+		}
+
+		if remaining > 0 {
+			if err := s.flush(); err != nil {
+				return nil, err
+			}
+			s.current, s.isNew = ix.nextBlock(s.current)
+		}
+	}
+	return locations, nil
+}
+
+// load reads the current block into memory, if it isn't already
+func (s *blockStager) load() error {
+	if s.block != nil {
+		return nil
+	}
+	var err error
+	if s.isNew {
+		s.block, err = NewBlock(s.current, s.index.blocks[s.current].Size)
+	} else {
+		s.block, err = readBlock(s.ctx, s.index.blockFilename(s.current), s.crypter, s.reader)
+	}
+	return err
+}
+
+// finish writes the current block, and waits for all the blocks to be written
+func (s *blockStager) finish() error {
+	if err := s.flush(); err != nil {
+		s.pool.wait()
+		return err
+	}
+	return s.pool.wait()
+}
+
+// flush starts writing the current block, if anything has been written to it
+func (s *blockStager) flush() error {
+	if s.block == nil {
+		return nil
+	}
+	ix := s.index
+	filename := s.current
+	if !s.isNew {
+		filename = ix.blockWriteName(s.current, s.writer)
+	}
+	if s.isNew || filename != ix.blockFilename(s.current) {
+		if err := ix.logWrites(s.ctx, []string{filename}, s.writer, s.crypter); err != nil {
+			return err
+		}
+	}
+	block := s.block
+	block.Filename = filename
+	ix.repointBlock(s.current, filename)
+	s.block = nil
+	return s.pool.submit(writeTask(block, s.crypter, s.writer))
+}
@@ -0,0 +1,89 @@
+package enstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDedupTestIndex(t *testing.T) (*Index, *testStore, Crypter) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Dedup = true
+	ix.config.DedupMinSize = 256
+	ix.config.DedupAvgSize = 1024
+	ix.config.DedupMaxSize = 4096
+	return ix, store, crypter
+}
+
+func allocatedBytes(ix *Index) int64 {
+	total := int64(0)
+	for _, allocations := range ix.blockAllocation {
+		for _, loc := range allocations {
+			total += loc.EndByte - loc.StartByte
+		}
+	}
+	return total
+}
+
+func TestDedup(t *testing.T) {
+	ix, store, crypter := newDedupTestIndex(t)
+	x := randomContents(20000, 1)
+	y := append(append(append([]byte{}, x[:10000]...), randomContents(500, 2)...), x[10000:]...)
+
+	assert.Nil(t, ix.AddFile(newTestFile("x", x), store, store, crypter))
+	assert.Equal(t, int64(len(x)), allocatedBytes(ix))
+	assert.Nil(t, ix.AddFile(newTestFile("y", y), store, store, crypter))
+	added := allocatedBytes(ix) - int64(len(x))
+	assert.True(t, added < 5000, added)
+	assertFileContents(t, ix, "x", x, store, crypter)
+	assertFileContents(t, ix, "y", y, store, crypter)
+
+	// Chunks and references survive saving and loading
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, ix.chunks, loaded.chunks)
+	assert.Equal(t, ix.chunkKey, loaded.chunkKey)
+	assert.Equal(t, allocatedBytes(ix), allocatedBytes(loaded))
+	ix = loaded
+
+	// Deleting x only frees the chunks y doesn't use
+	assert.Nil(t, ix.DeleteFile("x", store, store, crypter, true))
+	assert.Equal(t, int64(len(y)), allocatedBytes(ix))
+	assertFileContents(t, ix, "y", y, store, crypter)
+
+	// Adding x again reuses y's chunks
+	assert.Nil(t, ix.AddFile(newTestFile("x", x), store, store, crypter))
+	assert.True(t, allocatedBytes(ix)-int64(len(y)) < 5000)
+	assertFileContents(t, ix, "x", x, store, crypter)
+
+	assert.Nil(t, ix.DeleteFile("x", store, store, crypter, false))
+	assert.Nil(t, ix.DeleteFile("y", store, store, crypter, false))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.Equal(t, 0, len(ix.chunks))
+	assert.Equal(t, 0, len(ix.blocks))
+	assert.Equal(t, []string{ix.config.IndexFile}, storeNames(store))
+}
+
+func TestDedupRepeatedContents(t *testing.T) {
+	ix, store, crypter := newDedupTestIndex(t)
+	chunk := randomContents(4096, 3)
+	repeated := append(append(append([]byte{}, chunk...), chunk...), chunk...)
+
+	// A chunk repeated within a file is stored once, and referenced each time
+	assert.Nil(t, ix.AddFile(newTestFile("r", repeated), store, store, crypter))
+	assert.True(t, allocatedBytes(ix) < int64(len(repeated)))
+	assertFileContents(t, ix, "r", repeated, store, crypter)
+	assert.Nil(t, ix.AddFile(newTestFile("empty", []byte{}), store, store, crypter))
+	assertFileContents(t, ix, "empty", []byte{}, store, crypter)
+
+	assert.Nil(t, ix.DeleteFile("r", store, store, crypter, false))
+	assert.Equal(t, 0, len(ix.chunks))
+	assert.Equal(t, int64(0), allocatedBytes(ix))
+
+	// Files added without deduplication are unaffected
+	ix.config.Dedup = false
+	assert.Nil(t, ix.AddFile(newTestFile("plain", repeated), store, store, crypter))
+	assert.Equal(t, 0, len(ix.fileMap["plain"].Chunks))
+	assert.Equal(t, int64(len(repeated)), allocatedBytes(ix))
+}
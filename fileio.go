@@ -1,9 +1,14 @@
 package enstore
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 type LocalFileReadWriter struct {
@@ -11,37 +16,202 @@ type LocalFileReadWriter struct {
 }
 
 func (lfrw *LocalFileReadWriter) Read(filename string) ([]byte, error) {
-	if lfrw.BasePath != "" {
-		if lfrw.BasePath[len(lfrw.BasePath)-1] == '/' {
-			filename = fmt.Sprintf("%s%s", lfrw.BasePath, filename)
-		} else {
-			filename = fmt.Sprintf("%s/%s", lfrw.BasePath, filename)
-		}
+	return ioutil.ReadFile(lfrw.path(filename))
+}
+
+// ReadRange reads `length` bytes of a file starting at `offset`. If the file ends first, the bytes read and io.EOF are returned.
+func (lfrw *LocalFileReadWriter) ReadRange(filename string, offset int64, length int) ([]byte, error) {
+	file, err := os.Open(lfrw.path(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, offset)
+	if err == io.EOF && n == length {
+		err = nil
 	}
-	return ioutil.ReadFile(filename)
+	return buf[:n], err
 }
 
+// Write replaces a file atomically, by writing to a temporary file and renaming it over the original
 func (lfrw *LocalFileReadWriter) Write(filename string, bytes []byte) error {
-	if lfrw.BasePath != "" {
-		if lfrw.BasePath[len(lfrw.BasePath)-1] == '/' {
-			filename = fmt.Sprintf("%s%s", lfrw.BasePath, filename)
-		} else {
-			filename = fmt.Sprintf("%s/%s", lfrw.BasePath, filename)
-		}
+	path := lfrw.path(filename)
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(bytes); err != nil {
+		temp.Close()
+		return err
 	}
-	return ioutil.WriteFile(filename, bytes, 0644)
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
 }
 
 func (lfrw *LocalFileReadWriter) Exists(filename string) bool {
+	if _, err := os.Stat(lfrw.path(filename)); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// CheckExists returns true if the file exists, or an error if it couldn't be checked
+func (lfrw *LocalFileReadWriter) CheckExists(filename string) (bool, error) {
+	_, err := os.Stat(lfrw.path(filename))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes a file. Deleting a file which doesn't exist is not an error.
+func (lfrw *LocalFileReadWriter) Delete(filename string) error {
+	err := os.Remove(lfrw.path(filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the names of all files in BasePath
+func (lfrw *LocalFileReadWriter) List() ([]string, error) {
+	dir := lfrw.BasePath
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// Lock creates a lock file recording the process holding the lock. If the lock file exists, a *LockedError is returned,
+// unless the process which created it was on this host and has exited, in which case the stale lock is replaced.
+// The lock file is written under a temporary name and linked into place, so it's never seen half-written.
+// A stale lock is taken over by renaming it aside first, so if several processes find it at once, only one of them removes it,
+// and a lock another process has taken in the meantime is put back rather than removed.
+func (lfrw *LocalFileReadWriter) Lock(name string) error {
+	data, err := json.Marshal(newLockInfo())
+	if err != nil {
+		return err
+	}
+	temp := lfrw.asidePath(name, "new")
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	defer os.Remove(temp)
+	path := lfrw.path(name)
+	for {
+		err := os.Link(temp, path)
+		if err == nil || !os.IsExist(err) {
+			return err
+		}
+
+		holder, err := lfrw.readLock(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !holder.stale() {
+			return &LockedError{holder}
+		}
+		if err := lfrw.removeStaleLock(name); err != nil {
+			return err
+		}
+	}
+}
+
+// removeStaleLock moves the lock file to a unique name, and removes it if it's still stale.
+// If it's been replaced by a live lock since it was found to be stale, it's moved back and a *LockedError is returned.
+func (lfrw *LocalFileReadWriter) removeStaleLock(name string) error {
+	path := lfrw.path(name)
+	aside := lfrw.asidePath(name, "stale")
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(aside)
+
+	var holder LockInfo
+	data, err := ioutil.ReadFile(aside)
+	if err == nil {
+		err = json.Unmarshal(data, &holder)
+	}
+	if err == nil && holder.stale() {
+		return nil
+	}
+	// Linking rather than renaming it back leaves any lock taken since it was moved in place
+	if linkErr := os.Link(aside, path); linkErr != nil && !os.IsExist(linkErr) {
+		return linkErr
+	}
+	if err != nil {
+		return err
+	}
+	return &LockedError{holder}
+}
+
+// Unlock removes the lock file, if this process holds the lock
+func (lfrw *LocalFileReadWriter) Unlock(name string) error {
+	holder, err := lfrw.readLock(name)
+	if err != nil {
+		return err
+	}
+	if !holder.heldByThisProcess() {
+		return errors.New("the lock is held by another process")
+	}
+	return os.Remove(lfrw.path(name))
+}
+
+// asidePath returns a unique path next to a lock file for a temporary copy of it
+func (lfrw *LocalFileReadWriter) asidePath(name, kind string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return lfrw.path(fmt.Sprintf(".%s.%s.%x", name, kind, suffix))
+}
+
+// readLock reads a lock file
+func (lfrw *LocalFileReadWriter) readLock(name string) (LockInfo, error) {
+	var holder LockInfo
+	data, err := ioutil.ReadFile(lfrw.path(name))
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(data, &holder)
+	return holder, err
+}
+
+// path returns the path of a file relative to BasePath
+func (lfrw *LocalFileReadWriter) path(filename string) string {
 	if lfrw.BasePath != "" {
 		if lfrw.BasePath[len(lfrw.BasePath)-1] == '/' {
-			filename = fmt.Sprintf("%s%s", lfrw.BasePath, filename)
-		} else {
-			filename = fmt.Sprintf("%s/%s", lfrw.BasePath, filename)
+			return fmt.Sprintf("%s%s", lfrw.BasePath, filename)
 		}
+		return fmt.Sprintf("%s/%s", lfrw.BasePath, filename)
 	}
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return false
-	}
-	return true
+	return filename
 }
@@ -0,0 +1,375 @@
+package enstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// GetFileReader returns an io.ReadCloser which reads the unencrypted contents of a file in the index.
+// Each section of the file is read and decrypted as it is reached, so only one section is held in memory at a time,
+// and if the reader and crypter support it only the part of each block the section covers is read and decrypted.
+// Compressed files are decompressed as they're read. Once the file has been read to the end, its contents are checked against
+// the size and checksum in the index, and ErrChecksumMismatch is returned instead of io.EOF if they don't match.
+func (ix *Index) GetFileReader(filename string, reader BlockReader, crypter Crypter) (io.ReadCloser, error) {
+	return ix.GetFileReaderContext(context.Background(), filename, reader, crypter)
+}
+
+// GetFileReaderContext is GetFileReader, with reads returning the context's error once it's cancelled.
+// Closing the reader cancels any sections still being read ahead.
+func (ix *Index) GetFileReaderContext(ctx context.Context, filename string, reader BlockReader, crypter Crypter) (io.ReadCloser, error) {
+	ix.lock.RLock()
+	fileMeta, ok := ix.lookupFile(filename)
+	if !ok {
+		ix.lock.RUnlock()
+		return nil, errors.New("file does not exist in the index")
+	}
+	file := *fileMeta
+	locations := ix.blockFileLocations(file.Blocks)
+	ix.lock.RUnlock()
+	return ix.openFile(ctx, &file, locations, reader, crypter)
+}
+
+// openFile returns a reader for a file stored at `locations`, which name the block files to read
+func (ix *Index) openFile(ctx context.Context, fileMeta *FileMetadata, locations []BlockLocation, reader BlockReader, crypter Crypter) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &fileStreamReader{
+		locations: locations,
+		reader:    reader,
+		crypter:   crypter,
+		prefetch:  ix.config.Concurrency,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	if fileMeta.Compression == "" {
+		return newVerifyingReader(stream, fileMeta), nil
+	}
+	decompressor, err := newDecompressor(fileMeta.Compression, stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return newVerifyingReader(&decompressingReader{decompressor, stream}, fileMeta), nil
+}
+
+// fileStreamReader reads a file's sections in order, decrypting each as it is reached.
+// If `prefetch` is more than 1, up to that many of the following sections are read and decrypted in the background.
+type fileStreamReader struct {
+	locations []BlockLocation
+	reader    BlockReader
+	crypter   Crypter
+	prefetch  int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pending   []*sectionFetch
+	buf       []byte
+	err       error
+	closed    bool
+}
+
+// sectionFetch is a section of a file being read in the background. `done` is closed once it's been read.
+type sectionFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Read returns the next decrypted bytes of the file
+func (f *fileStreamReader) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("read from closed file reader")
+	}
+
+	for len(f.buf) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.buf, f.err = f.next()
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// next returns the next section of the file, or io.EOF at the end of it
+func (f *fileStreamReader) next() ([]byte, error) {
+	if f.prefetch <= 1 {
+		if len(f.locations) == 0 {
+			return nil, io.EOF
+		}
+		loc := f.locations[0]
+		f.locations = f.locations[1:]
+		return readBlockRange(f.ctx, loc.Block, loc.StartByte, loc.EndByte, f.crypter, f.reader)
+	}
+
+	for len(f.pending) < f.prefetch && len(f.locations) > 0 {
+		loc := f.locations[0]
+		f.locations = f.locations[1:]
+		fetch := &sectionFetch{done: make(chan struct{})}
+		f.pending = append(f.pending, fetch)
+		go func() {
+			fetch.data, fetch.err = readBlockRange(f.ctx, loc.Block, loc.StartByte, loc.EndByte, f.crypter, f.reader)
+			close(fetch.done)
+		}()
+	}
+	if len(f.pending) == 0 {
+		return nil, io.EOF
+	}
+	fetch := f.pending[0]
+	f.pending = f.pending[1:]
+	<-fetch.done
+	return fetch.data, fetch.err
+}
+
+// Close releases the reader's buffer, and cancels reading any sections still being read in the background.
+// Any further reads will return an error.
+func (f *fileStreamReader) Close() error {
+	f.cancel()
+	f.closed = true
+	f.buf = nil
+	f.locations = nil
+	f.pending = nil
+	return nil
+}
+
+// DefaultFileReaderCacheSize is the number of bytes of decrypted sections a FileReader keeps cached (1 MiB).
+// The most recently read section is always kept, even if it's larger than this.
+const DefaultFileReaderCacheSize int = 1048576
+
+// FileReader provides random access to the unencrypted contents of a file in the index.
+// It implements io.Reader, io.Seeker and io.ReaderAt. Only the blocks covering the bytes being read are fetched,
+// and the most recently read sections are kept in a small cache. ReadAt may be called concurrently, Read and Seek may not.
+// Contents read with a FileReader aren't checked against the file's checksum, see Index.Verify.
+// Compressed files can't be read from the middle, so they're decompressed from the start, continuing on from the last read
+// if it was before the offset being read; reading them backwards is slow.
+type FileReader struct {
+	locations  []BlockLocation
+	offsets    []int64
+	size       int64
+	storedSize int64
+	windowSize int64
+	reader     BlockReader
+	crypter    Crypter
+	ctx        context.Context
+	position   int64
+	cacheLock  sync.Mutex
+	cache      []cachedWindow
+	cacheBytes int
+	cacheSize  int
+
+	compression      string
+	decompressLock   sync.Mutex
+	decompressor     io.ReadCloser
+	decompressedSize int64
+}
+
+// cachedWindow is a decrypted section of one of a file's locations
+type cachedWindow struct {
+	location int
+	window   int64
+	bytes    []byte
+}
+
+// Open returns a FileReader for random access to a file in the index
+func (ix *Index) Open(filename string, reader BlockReader, crypter Crypter) (*FileReader, error) {
+	return ix.OpenContext(context.Background(), filename, reader, crypter)
+}
+
+// OpenContext is Open, with reads returning the context's error once it's cancelled
+func (ix *Index) OpenContext(ctx context.Context, filename string, reader BlockReader, crypter Crypter) (*FileReader, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	fileMeta, ok := ix.lookupFile(filename)
+	if !ok {
+		return nil, errors.New("file does not exist in the index")
+	}
+
+	file := &FileReader{
+		locations:   ix.blockFileLocations(fileMeta.Blocks),
+		offsets:     make([]int64, len(fileMeta.Blocks)),
+		size:        fileMeta.Size,
+		reader:      reader,
+		crypter:     crypter,
+		ctx:         ctx,
+		compression: fileMeta.Compression,
+		cacheSize:   DefaultFileReaderCacheSize,
+	}
+	for i, loc := range file.locations {
+		file.offsets[i] = file.storedSize
+		file.storedSize += loc.EndByte - loc.StartByte
+	}
+
+	// If parts of blocks can be read and decrypted, fetch locations in windows of the crypter's segment size, otherwise whole locations are read at once
+	rangeDecrypter, canDecrypt := crypter.(RangeDecrypter)
+	_, canRead := reader.(BlockRangeReader)
+	if canDecrypt && canRead && rangeDecrypter.SegmentSize() > 0 {
+		file.windowSize = int64(rangeDecrypter.SegmentSize())
+	}
+	return file, nil
+}
+
+// Size returns the size of the file
+func (f *FileReader) Size() int64 {
+	return f.size
+}
+
+// Read reads from the current position in the file
+func (f *FileReader) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.position)
+	f.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position of the next Read, interpreted according to `whence`
+func (f *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.position
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.position = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes from the file starting at offset `off`
+func (f *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if f.compression != "" {
+		return f.readDecompressedAt(p, off)
+	}
+	return f.readStoredAt(p, off)
+}
+
+// readDecompressedAt reads from a compressed file, restarting decompression if the offset is before the last read
+func (f *FileReader) readDecompressedAt(p []byte, off int64) (int, error) {
+	f.decompressLock.Lock()
+	defer f.decompressLock.Unlock()
+
+	if f.decompressor == nil || off < f.decompressedSize {
+		decompressor, err := newDecompressor(f.compression, io.NewSectionReader(storedReaderAt{f}, 0, f.storedSize))
+		if err != nil {
+			return 0, err
+		}
+		f.decompressor = decompressor
+		f.decompressedSize = 0
+	}
+	if off > f.decompressedSize {
+		skipped, err := io.CopyN(ioutil.Discard, f.decompressor, off-f.decompressedSize)
+		f.decompressedSize += skipped
+		if err != nil {
+			return 0, f.decompressError(err)
+		}
+	}
+
+	n, err := io.ReadFull(f.decompressor, p)
+	f.decompressedSize += int64(n)
+	return n, f.decompressError(err)
+}
+
+// decompressError turns a short read into io.EOF, and discards the decompressor after any other error so the next read starts again
+func (f *FileReader) decompressError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	if err != nil && err != io.EOF {
+		f.decompressor = nil
+	}
+	return err
+}
+
+// storedReaderAt reads the bytes stored for a file, which are compressed if the file is
+type storedReaderAt struct {
+	file *FileReader
+}
+
+func (s storedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.readStoredAt(p, off)
+}
+
+// readStoredAt reads len(p) of the bytes stored for the file starting at offset `off`
+func (f *FileReader) readStoredAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < f.storedSize {
+		// Find the last location starting at or before the offset
+		idx := sort.Search(len(f.offsets), func(i int) bool {
+			return f.offsets[i] > off
+		}) - 1
+		locationOffset := off - f.offsets[idx]
+
+		window, windowStart, err := f.window(idx, locationOffset)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], window[locationOffset-windowStart:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// window returns the decrypted window of location `idx` containing `offset` (relative to the start of the location),
+// and the offset the window starts at. Windows are aligned to the block's segments, and clipped to the location,
+// so reading one never decrypts more than one segment.
+func (f *FileReader) window(idx int, offset int64) ([]byte, int64, error) {
+	loc := f.locations[idx]
+	window, start, end := int64(0), int64(0), loc.EndByte-loc.StartByte
+	if f.windowSize > 0 {
+		window = (loc.StartByte + offset) / f.windowSize
+		if windowStart := window*f.windowSize - loc.StartByte; windowStart > start {
+			start = windowStart
+		}
+		if windowEnd := (window+1)*f.windowSize - loc.StartByte; windowEnd < end {
+			end = windowEnd
+		}
+	}
+
+	f.cacheLock.Lock()
+	for i, cached := range f.cache {
+		if cached.location == idx && cached.window == window {
+			// Move to the front, as the most recently used
+			copy(f.cache[1:i+1], f.cache[:i])
+			f.cache[0] = cached
+			f.cacheLock.Unlock()
+			return cached.bytes, start, nil
+		}
+	}
+	f.cacheLock.Unlock()
+
+	data, err := readBlockRange(f.ctx, loc.Block, loc.StartByte+start, loc.StartByte+end, f.crypter, f.reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f.cacheLock.Lock()
+	f.cache = append(f.cache, cachedWindow{})
+	copy(f.cache[1:], f.cache)
+	f.cache[0] = cachedWindow{idx, window, data}
+	f.cacheBytes += len(data)
+	// Evict the least recently used windows until the cache fits, always keeping the one just read
+	for len(f.cache) > 1 && f.cacheBytes > f.cacheSize {
+		f.cacheBytes -= len(f.cache[len(f.cache)-1].bytes)
+		f.cache = f.cache[:len(f.cache)-1]
+	}
+	f.cacheLock.Unlock()
+	return data, start, nil
+}
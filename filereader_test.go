@@ -0,0 +1,143 @@
+package enstore
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFileReader(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	contents := testContents(100)
+	assert.Nil(t, ix.AddFile(newTestFile("file", contents), store, store, crypter))
+
+	store.bytesRead = 0
+	file, err := ix.GetFileReader("file", store, crypter)
+	assert.Nil(t, err)
+	read, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, contents, read)
+	// Only the header and the first segment of the block should have been read, not the whole block
+	assert.True(t, store.bytesRead < 512)
+
+	assert.Nil(t, file.Close())
+	_, err = file.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	contents := testContents(10000)
+	assert.Nil(t, ix.AddFile(newTestFile("file", contents), store, store, crypter))
+
+	file, err := ix.Open("file", store, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(contents)), file.Size())
+	// Blocks are read in windows of the crypter's segment size
+	assert.Equal(t, int64(256), file.windowSize)
+
+	tests := []struct {
+		testname      string
+		offset        int64
+		length        int
+		expectedN     int
+		expectedError error
+	}{
+		{"Start", 0, 10, 10, nil},
+		{"Middle of a block", 5000, 10, 10, nil},
+		{"Across blocks", 4000, 200, 200, nil},
+		{"Past end", 9990, 20, 10, io.EOF},
+		{"At end", 10000, 1, 0, io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.testname, func(t *testing.T) {
+			store.bytesRead = 0
+			buf := make([]byte, test.length)
+			n, err := file.ReadAt(buf, test.offset)
+			assert.Equal(t, test.expectedN, n)
+			assert.Equal(t, test.expectedError, err)
+			assert.Equal(t, contents[test.offset:test.offset+int64(n)], buf[:n])
+			// No more than the blocks covering the range should be read
+			assert.True(t, store.bytesRead <= 2*4096+1024)
+		})
+	}
+
+	// Sections which have already been read are cached
+	store.bytesRead = 0
+	_, err = file.ReadAt(make([]byte, 10), 5005)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, store.bytesRead)
+
+	// Seek and Read
+	pos, err := file.Seek(-100, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9900), pos)
+	rest, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, contents[9900:], rest)
+
+	_, err = file.Seek(1000, io.SeekStart)
+	assert.Nil(t, err)
+	pos, err = file.Seek(-500, io.SeekCurrent)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(500), pos)
+	all, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, contents[500:], all)
+
+	_, err = file.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err)
+}
+
+func TestOpenWindowAlignment(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("first", testContents(100)), store, store, crypter))
+	contents := randomContents(10000, 1)
+	assert.Nil(t, ix.AddFile(newTestFile("file", contents), store, store, crypter))
+
+	// The file starts part way through a segment, but each window still only covers one segment of the block
+	file, err := ix.Open("file", store, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), file.locations[0].StartByte)
+	for off := int64(0); off < file.storedSize; off += 50 {
+		idx := 0
+		for idx+1 < len(file.offsets) && file.offsets[idx+1] <= off {
+			idx++
+		}
+		loc := file.locations[idx]
+		window, start, err := file.window(idx, off-file.offsets[idx])
+		assert.Nil(t, err)
+		first, last := (loc.StartByte+start)/file.windowSize, (loc.StartByte+start+int64(len(window))-1)/file.windowSize
+		assert.Equal(t, first, last, "offset %d", off)
+		assert.Equal(t, contents[file.offsets[idx]+start:][:len(window)], window)
+	}
+}
+
+// nonRangeReader hides a reader's ReadRange method
+type nonRangeReader struct {
+	BlockReader
+}
+
+func TestOpenCacheSize(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	contents := testContents(10000)
+	assert.Nil(t, ix.AddFile(newTestFile("file", contents), store, store, crypter))
+
+	// Without range reads each window is a whole location, and the cache is limited by the bytes it holds rather than the windows
+	file, err := ix.Open("file", &nonRangeReader{store}, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), file.windowSize)
+	file.cacheSize = 5000
+	read, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, contents, read)
+	assert.True(t, file.cacheBytes <= file.cacheSize)
+	assert.True(t, len(file.cache) < len(file.locations))
+	total := 0
+	for _, cached := range file.cache {
+		total += len(cached.bytes)
+	}
+	assert.Equal(t, total, file.cacheBytes)
+}
@@ -2,4 +2,9 @@ module github.com/IfSentient/enstore
 
 go 1.14
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/pkg/sftp v1.13.6
+	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
+)
@@ -1,11 +1,12 @@
 package enstore
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"sort"
+	"sync"
 )
 
 // IndexReader exposes BlockReader method(s), and a method to check the existence of a file
@@ -14,6 +15,21 @@ type IndexReader interface {
 	Exists(filename string) bool
 }
 
+// ExistsChecker is implemented by IndexReaders which can fail to find out whether a file exists, such as remote stores.
+// CheckExists returns false only if the file doesn't exist, and an error if that couldn't be found out.
+type ExistsChecker interface {
+	CheckExists(filename string) (bool, error)
+}
+
+// FileExists returns true if the file exists. If the reader is an ExistsChecker, any error finding out is returned,
+// so a store which can't be reached isn't mistaken for an empty one.
+func FileExists(reader IndexReader, filename string) (bool, error) {
+	if checker, ok := reader.(ExistsChecker); ok {
+		return checker.CheckExists(filename)
+	}
+	return reader.Exists(filename), nil
+}
+
 // IndexWriter mirrors BlockWriter
 type IndexWriter interface {
 	BlockWriter
@@ -37,6 +53,15 @@ type FileMetadata struct {
 	Filename string
 	Size     int64
 	Blocks   []BlockLocation
+	// Chunks are the IDs of the deduplicated chunks the file is made of, if it was added with Config.Dedup
+	Chunks []string `json:",omitempty"`
+	// Compression is the algorithm the file's contents were compressed with, if any, and StoredSize their compressed size
+	Compression string `json:",omitempty"`
+	StoredSize  int64  `json:",omitempty"`
+	// SHA256 is the hex-encoded SHA-256 of the file's contents, checked when the file is read
+	SHA256 string `json:",omitempty"`
+	// Attributes are the file's mode, modification time, ownership and link target, if its File was an AttributeProvider
+	Attributes *FileAttributes `json:",omitempty"`
 }
 
 // BlockLocation describes a section of bytes on a block
@@ -50,28 +75,67 @@ type indexJson struct {
 	Files      []FileMetadata
 	Blocks     map[string]BlockMetadata
 	StartBlock string
+	Generation int64
+	Snapshots  []SnapshotMetadata        `json:",omitempty"`
+	Chunks     map[string]*ChunkMetadata `json:",omitempty"`
+	ChunkKey   []byte                    `json:",omitempty"`
 }
 
 // Index keeps track of all files and blocks and where all files exist across each block.
-// It has methods for adding, removing, getting, and listing files on the blocks.
+// It has methods for adding, removing, getting, and listing files on the blocks. It is safe for concurrent use.
 type Index struct {
+	// lock is held to read the index, and to replace its state with a changed copy.
+	// writeLock is held for the whole of a change or save, so the goroutine holding it can read the state without lock.
+	lock      sync.RWMutex
+	writeLock sync.Mutex
+
 	files           []FileMetadata
 	blocks          map[string]BlockMetadata
 	startBlock      string
 	fileMap         map[string]*FileMetadata
 	blockAllocation map[string][]BlockLocation
 	config          *Config
+	generation      int64
+	written         map[string]bool
+	writing         map[string]bool
+	superseded      []string
+	abandoned       []string
+	snapshots       []SnapshotMetadata
+	protected       map[string]bool
+	readOnly        bool
+	chunks          map[string]*ChunkMetadata
+	chunkKey        []byte
 }
 
 // LoadIndex will attempt to load an existing index file and decrypt its store. If no file exists,
-// it will create a new one with the supplied key.
+// it will create a new one with the supplied key. Loading never changes the store. If a journal was left by an interrupted Save,
+// the block files it abandoned are deleted when the index is next saved, finishing or rolling back the commit.
 func LoadIndex(reader IndexReader, crypter Crypter, cfg *Config) (*Index, error) {
-	if !reader.Exists(cfg.IndexFile) {
-		return NewIndex(cfg), nil
+	return LoadIndexContext(context.Background(), reader, crypter, cfg)
+}
+
+// LoadIndexContext is LoadIndex, stopping if the context is cancelled
+func LoadIndexContext(ctx context.Context, reader IndexReader, crypter Crypter, cfg *Config) (*Index, error) {
+	index := NewIndex(cfg)
+	exists, err := FileExists(reader, cfg.IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if index, err = readIndex(ctx, reader, cfg.IndexFile, crypter, cfg); err != nil {
+			return nil, err
+		}
 	}
+	if err := index.readJournal(ctx, reader, crypter); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
 
+// readIndex reads and decrypts an index file
+func readIndex(ctx context.Context, reader BlockReader, filename string, crypter Crypter, cfg *Config) (*Index, error) {
 	var tempIndex indexJson
-	data, err := reader.Read(cfg.IndexFile)
+	data, err := readContext(ctx, reader, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -91,28 +155,48 @@ func LoadIndex(reader IndexReader, crypter Crypter, cfg *Config) (*Index, error)
 		fileMap:         make(map[string]*FileMetadata),
 		blockAllocation: make(map[string][]BlockLocation),
 		config:          cfg,
+		generation:      tempIndex.Generation,
+		written:         make(map[string]bool),
+		snapshots:       tempIndex.Snapshots,
+		chunks:          tempIndex.Chunks,
+		chunkKey:        tempIndex.ChunkKey,
+	}
+	index.rebuildProtected()
+	if index.chunks == nil {
+		index.chunks = make(map[string]*ChunkMetadata)
 	}
 
-	// Build out the block allocation and file maps from the loaded data
+	// Build out the block allocation and file maps from the loaded data.
+	// Deduplicated files share their chunks' locations, so those are allocated once per chunk instead.
 	for i := 0; i < len(index.files); i++ {
 		file := index.files[i]
 		index.fileMap[file.Filename] = &index.files[i]
-		for _, loc := range file.Blocks {
-			locations, ok := index.blockAllocation[loc.Block]
-			if !ok {
-				locations = make([]BlockLocation, 0)
-			}
-			locations = append(locations, loc)
-			sort.Slice(locations, func(i, j int) bool {
-				return locations[i].StartByte < locations[j].StartByte
-			})
-			index.blockAllocation[loc.Block] = locations
+		if len(file.Chunks) == 0 {
+			index.allocateLocations(file.Blocks)
 		}
 	}
+	for _, chunk := range index.chunks {
+		index.allocateLocations(chunk.Blocks)
+	}
 
 	return &index, nil
 }
 
+// allocateLocations adds loaded locations to the block allocation map
+func (ix *Index) allocateLocations(locations []BlockLocation) {
+	for _, loc := range locations {
+		allocations, ok := ix.blockAllocation[loc.Block]
+		if !ok {
+			allocations = make([]BlockLocation, 0)
+		}
+		allocations = append(allocations, loc)
+		sort.Slice(allocations, func(i, j int) bool {
+			return allocations[i].StartByte < allocations[j].StartByte
+		})
+		ix.blockAllocation[loc.Block] = allocations
+	}
+}
+
 // NewIndex returns an empty index
 func NewIndex(cfg *Config) *Index {
 	return &Index{
@@ -122,15 +206,49 @@ func NewIndex(cfg *Config) *Index {
 		fileMap:         make(map[string]*FileMetadata),
 		blockAllocation: make(map[string][]BlockLocation),
 		config:          cfg,
+		written:         make(map[string]bool),
+		protected:       make(map[string]bool),
+		chunks:          make(map[string]*ChunkMetadata),
 	}
 }
 
-// Save will save the index encrypted with the supplied key, using the IndexWriter to write the file
+// Save will save the index encrypted with the supplied key, using the IndexWriter to write the file, committing the changes made since it was last saved.
+// The IndexWriter should replace the index atomically. ErrIndexChanged is returned if another process has saved the index since this one was loaded.
 func (ix *Index) Save(writer IndexWriter, crypter Crypter) error {
+	return ix.SaveContext(context.Background(), writer, crypter)
+}
+
+// SaveContext is Save, stopping if the context is cancelled
+func (ix *Index) SaveContext(ctx context.Context, writer IndexWriter, crypter Crypter) error {
+	ix.writeLock.Lock()
+	defer ix.writeLock.Unlock()
+	if ix.readOnly {
+		return ErrReadOnlyIndex
+	}
+	return ix.save(ctx, writer, crypter)
+}
+
+// save saves the index. The caller must hold writeLock.
+func (ix *Index) save(ctx context.Context, writer IndexWriter, crypter Crypter) error {
+	condition, err := ix.checkGeneration(ctx, writer, crypter)
+	if err != nil {
+		return err
+	}
+	pending := ix.hasPendingChanges()
+	if pending {
+		if err := ix.writeJournal(ctx, writer, crypter); err != nil {
+			return err
+		}
+	}
+
 	jsonIndex := indexJson{
 		Files:      ix.files,
 		Blocks:     ix.blocks,
 		StartBlock: ix.startBlock,
+		Generation: ix.generation + 1,
+		Snapshots:  ix.snapshots,
+		Chunks:     ix.chunks,
+		ChunkKey:   ix.chunkKey,
 	}
 
 	jsonBytes, err := json.Marshal(jsonIndex)
@@ -142,107 +260,238 @@ func (ix *Index) Save(writer IndexWriter, crypter Crypter) error {
 		return err
 	}
 
-	return writer.Write(ix.config.IndexFile, data)
+	if err := ix.writeIndex(ctx, writer, data, condition); err != nil {
+		return err
+	}
+	ix.lock.Lock()
+	ix.generation++
+	superseded := append(ix.superseded, ix.abandoned...)
+	ix.written = make(map[string]bool)
+	ix.superseded = nil
+	ix.abandoned = nil
+	ix.lock.Unlock()
+
+	deleter, ok := writer.(BlockDeleter)
+	if !ok || !pending {
+		return nil
+	}
+	for i, filename := range superseded {
+		err := ctx.Err()
+		if err == nil {
+			err = deleter.Delete(filename)
+		}
+		if err != nil {
+			// The journal is still there, but keep track of what's left in case the index is saved again first
+			ix.lock.Lock()
+			ix.superseded = superseded[i:]
+			ix.lock.Unlock()
+			return err
+		}
+	}
+	return deleter.Delete(ix.config.JournalFile)
 }
 
 // ListFiles returns a slice of all the files in the index.
 // This slice is a copy of the internal store, so manipulations can be performed on it
 func (ix *Index) ListFiles() []FileMetadata {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
 	files := make([]FileMetadata, len(ix.files))
 	copy(files, ix.files)
 	return files
 }
 
-// GetFile will read all blocks a file in the index is stored on, and assemble and return the unencrypted file
+// GetFile will read all blocks a file in the index is stored on, and write the unencrypted file to `destination`
 func (ix *Index) GetFile(filename string, destination io.Writer, reader BlockReader, crypter Crypter) error {
-	fileMeta, ok := ix.fileMap[filename]
-	if !ok {
-		return errors.New("file does not exist in the index")
-	}
+	return ix.GetFileContext(context.Background(), filename, destination, reader, crypter)
+}
 
-	for _, loc := range fileMeta.Blocks {
-		block, err := ReadBlock(loc.Block, crypter, reader)
-		if err != nil {
-			return err
-		}
-		destination.Write(block.Bytes[loc.StartByte:loc.EndByte])
+// GetFileContext is GetFile, stopping if the context is cancelled
+func (ix *Index) GetFileContext(ctx context.Context, filename string, destination io.Writer, reader BlockReader, crypter Crypter) error {
+	file, err := ix.GetFileReaderContext(ctx, filename, reader, crypter)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return nil
+	_, err = io.Copy(destination, file)
+	return err
 }
 
-// AddFile will add a file to the index and write it to any blocks with space, creating new blocks as necessary
+// AddFile will add a file to the index and write it to any blocks with space, creating new blocks as necessary.
+// If Config.Dedup is set, only the parts of the file which aren't already stored are written.
+// Otherwise, if Config.Compression is set, the file is compressed before it's written, unless it doesn't compress.
+// The file is stored under its name normalized with CleanPath, along with its attributes if it's an AttributeProvider.
+// ErrFileExists is returned if a file with that name is already in the index (use ReplaceFile to replace it),
+// or if the name clashes with a directory in the index, or one of its parent directories is a file.
 func (ix *Index) AddFile(file File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
-	blockLocations := make([]BlockLocation, 0)
-	newBlocks := make(map[string]bool, 0)
-	fileSize := file.Size()
-	remainingSize := fileSize
-
-	// Iterate through the blocks looking for open chunks
-	var block *BlockMetadata
-	if ix.startBlock == "" {
-		block, _ = ix.nextBlock("")
-		ix.startBlock = block.Filename
-		newBlocks[block.Filename] = true
-	} else {
-		b := ix.blocks[ix.startBlock]
-		block = &b
-	}
-	for remainingSize > 0 {
-		locs, spaceFound := ix.findSpaceInBlock(block, int(remainingSize))
-		remainingSize -= int64(spaceFound)
-		blockLocations = append(blockLocations, locs...)
-		ix.addBlockAllocations(block.Filename, blockLocations)
-
-		if remainingSize > 0 {
-			var isNew bool
-			block, isNew = ix.nextBlock(block.Filename)
-			if isNew {
-				newBlocks[block.Filename] = true
-			}
-		}
-	}
+	return ix.AddFilesContext(context.Background(), []File{file}, reader, writer, crypter)
+}
 
-	for _, loc := range blockLocations {
-		var block *Block
-		var err error
-		if newBlocks[loc.Block] {
-			block, err = NewBlock(loc.Block, ix.blocks[loc.Block].Size)
-		} else {
-			block, err = ReadBlock(loc.Block, crypter, reader)
-		}
-		if err != nil {
-			return err
-		}
+// AddFileContext is AddFile, stopping if the context is cancelled
+func (ix *Index) AddFileContext(ctx context.Context, file File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	return ix.AddFilesContext(ctx, []File{file}, reader, writer, crypter)
+}
+
+// AddFiles adds several files to the index, as AddFile does. Space for all the files is found in one pass along the chain of blocks,
+// so each block any of them are written to is read and written once, however many of the files are on it.
+// Nothing is written if any of the names are invalid, clash with the index, or clash with each other.
+func (ix *Index) AddFiles(files []File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	return ix.AddFilesContext(context.Background(), files, reader, writer, crypter)
+}
+
+// AddFilesContext is AddFiles, stopping if the context is cancelled. As with any other error, none of the files are added if it's cancelled.
+func (ix *Index) AddFilesContext(ctx context.Context, files []File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	return ix.update(func(work *Index) error {
+		return work.addFiles(ctx, files, reader, writer, crypter)
+	})
+}
 
-		buf := make([]byte, loc.EndByte-loc.StartByte)
-		n, err := file.Read(buf)
+func (ix *Index) addFiles(ctx context.Context, files []File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	names := make([]string, len(files))
+	for i, file := range files {
+		name, err := CleanPath(file.Name())
 		if err != nil {
 			return err
 		}
-		if n != len(buf) {
-			return fmt.Errorf("expected to read %d bytes from file, only read %d bytes", len(buf), n)
+		names[i] = name
+	}
+	existingFiles, existingDirs := ix.indexPaths(nil)
+	if err := checkNewNames(names, existingFiles, existingDirs); err != nil {
+		return err
+	}
+
+	stager := ix.newBlockStager(ctx, reader, writer, crypter)
+	added := make([]FileMetadata, 0, len(files))
+	for i, file := range files {
+		fileMeta, err := ix.stageFile(&renamedFile{file, names[i]}, fileAttributes(file), stager)
+		if err == nil {
+			err = ctx.Err()
 		}
-		_, err = block.Update(int(loc.StartByte), buf)
 		if err != nil {
+			stager.pool.wait()
 			return err
 		}
+		added = append(added, fileMeta)
+	}
+	if err := stager.finish(); err != nil {
+		return err
+	}
+
+	ix.files = append(ix.files, added...)
+	ix.reindexFiles()
+	return nil
+}
+
+// stageFile copies a file's contents to the stager's blocks, compressing them or splitting them into deduplicated chunks as configured,
+// and returns the file's metadata
+func (ix *Index) stageFile(file File, attributes *FileAttributes, stager *blockStager) (FileMetadata, error) {
+	hashed := newHashingFile(file)
+	if ix.config.Dedup {
+		return ix.stageDedupFile(hashed, attributes, stager)
+	}
+	file = hashed
 
-		err = WriteBlock(block, crypter, writer)
+	fileMeta := FileMetadata{
+		Filename:   file.Name(),
+		Size:       file.Size(),
+		Attributes: attributes,
+	}
+	if ix.config.Compression != "" {
+		stored, compressed, err := compressFile(file, ix.config.Compression)
 		if err != nil {
-			return err
+			return FileMetadata{}, err
 		}
+		defer stored.Close()
+		if compressed {
+			fileMeta.Compression = ix.config.Compression
+			fileMeta.StoredSize = stored.Size()
+		}
+		file = stored
 	}
 
-	ix.files = append(ix.files, FileMetadata{
-		Filename: file.Name(),
-		Size:     file.Size(),
-		Blocks:   blockLocations,
+	blocks, err := stager.storeFrom(file, file.Size())
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	fileMeta.Blocks = blocks
+	fileMeta.SHA256 = hashed.sum()
+	return fileMeta, nil
+}
+
+// ReplaceFile replaces the contents of a file in the index, or adds it if it isn't in the index yet.
+// The space the old contents used is freed first, so the new contents are written to it where they fit, and any blocks left empty are released.
+// Deduplicated files are added before the old contents are freed instead, so chunks both versions share aren't written again,
+// as are files replaced with a writer which isn't a BlockDeleter, as it overwrites blocks in place.
+// Like other changes, the old contents are only replaced in the store when the index is saved. If an error is returned, the old contents are kept.
+func (ix *Index) ReplaceFile(file File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	return ix.ReplaceFileContext(context.Background(), file, reader, writer, crypter)
+}
+
+// ReplaceFileContext is ReplaceFile, stopping if the context is cancelled
+func (ix *Index) ReplaceFileContext(ctx context.Context, file File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	return ix.update(func(work *Index) error {
+		return work.replaceFile(ctx, file, reader, writer, crypter)
 	})
+}
 
+func (ix *Index) replaceFile(ctx context.Context, file File, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	fileMeta, exists := ix.lookupFile(file.Name())
+	if !exists {
+		return ix.addFiles(ctx, []File{file}, reader, writer, crypter)
+	}
+	old := *fileMeta
+	// Space freed first is only reused through copies of its blocks if the writer can delete the old ones
+	_, canDelete := writer.(BlockDeleter)
+	freeFirst := len(old.Chunks) == 0 && canDelete
+
+	// Removing the old file from the index first lets the new one take its name
+	freed := make([]BlockLocation, 0)
+	if freeFirst {
+		freed = ix.freedLocations(&old)
+		for _, loc := range freed {
+			ix.removeBlockAllocation(loc)
+		}
+	}
+	for i, f := range ix.files {
+		if f.Filename == old.Filename {
+			ix.files = append(ix.files[:i], ix.files[i+1:]...)
+			break
+		}
+	}
+	ix.reindexFiles()
+
+	if err := ix.addFiles(ctx, []File{file}, reader, writer, crypter); err != nil {
+		return err
+	}
+	if !freeFirst {
+		freed = ix.freedLocations(&old)
+		for _, loc := range freed {
+			ix.removeBlockAllocation(loc)
+		}
+		ix.releaseChunks(&old)
+	}
+
+	touched := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, loc := range freed {
+		if !seen[loc.Block] {
+			seen[loc.Block] = true
+			touched = append(touched, loc.Block)
+		}
+	}
+	ix.releaseEmptyBlocks(touched, writer)
 	return nil
 }
 
+// reindexFiles rebuilds the file map, which points into the files slice, after files are added or removed
+func (ix *Index) reindexFiles() {
+	ix.fileMap = make(map[string]*FileMetadata, len(ix.files))
+	for i := range ix.files {
+		ix.fileMap[ix.files[i].Filename] = &ix.files[i]
+	}
+}
+
 func (ix *Index) addBlockAllocations(block string, newAllocations []BlockLocation) {
 	bAlloc := append(ix.blockAllocation[block], newAllocations...)
 	sort.Slice(bAlloc, func(i, j int) bool {
@@ -251,11 +500,13 @@ func (ix *Index) addBlockAllocations(block string, newAllocations []BlockLocatio
 	ix.blockAllocation[block] = bAlloc
 }
 
-func (ix *Index) findSpaceInBlock(block *BlockMetadata, space int) ([]BlockLocation, int) {
+// findSpaceInBlock finds free space on a block for up to `space` bytes, returning the locations found and how many bytes they hold
+func (ix *Index) findSpaceInBlock(name string, space int) ([]BlockLocation, int) {
 	remainingSize := int64(space)
 	blockLocations := make([]BlockLocation, 0)
+	block := ix.blocks[name]
 
-	allocations, ok := ix.blockAllocation[block.Filename]
+	allocations, ok := ix.blockAllocation[name]
 	// If there are no allocations on this block, we can use as much of it as we need
 	if !ok || len(allocations) == 0 {
 		writeLength := remainingSize
@@ -264,19 +515,15 @@ func (ix *Index) findSpaceInBlock(block *BlockMetadata, space int) ([]BlockLocat
 		}
 		remainingSize -= writeLength
 		allocation := BlockLocation{
-			Block:     block.Filename,
+			Block:     name,
 			StartByte: 0,
 			EndByte:   writeLength,
 		}
 		blockLocations = append(blockLocations, allocation)
-		newAllocation := make([]BlockLocation, 0)
-		newAllocation = append(newAllocation, allocation)
-		ix.blockAllocation[block.Filename] = newAllocation
 	} else {
 		// Otherwise, look for gaps in the allocations of at least CHUNKSIZE,
 		// and create allocations for bits of the file there
 		last := int64(0)
-		newAllocations := allocations
 		for _, allocation := range allocations {
 			if allocation.StartByte-last >= int64(ix.config.ChunkSize) {
 				// We can add a chunk
@@ -288,12 +535,11 @@ func (ix *Index) findSpaceInBlock(block *BlockMetadata, space int) ([]BlockLocat
 					}
 				}
 				newAllocation := BlockLocation{
-					Block:     block.Filename,
+					Block:     name,
 					StartByte: last,
 					EndByte:   last + chunkSize,
 				}
 				blockLocations = append(blockLocations, newAllocation)
-				newAllocations = append(newAllocations, newAllocation)
 				remainingSize -= chunkSize
 			}
 			last = allocation.EndByte
@@ -315,12 +561,11 @@ func (ix *Index) findSpaceInBlock(block *BlockMetadata, space int) ([]BlockLocat
 				}
 			}
 			newAllocation := BlockLocation{
-				Block:     block.Filename,
+				Block:     name,
 				StartByte: last,
 				EndByte:   last + chunkSize,
 			}
 			blockLocations = append(blockLocations, newAllocation)
-			newAllocations = append(newAllocations, newAllocation)
 			remainingSize -= chunkSize
 		}
 	}
@@ -328,64 +573,145 @@ func (ix *Index) findSpaceInBlock(block *BlockMetadata, space int) ([]BlockLocat
 	return blockLocations, space - int(remainingSize)
 }
 
+// DeleteFile removes a file from the index. If `zeroOut` is true, the file's bytes are overwritten with zeros on the blocks it was on.
+// Blocks left with nothing on them are unlinked from the index if the writer is a BlockDeleter, and deleted when the index is next saved.
 func (ix *Index) DeleteFile(filename string, reader BlockReader, writer BlockWriter, crypter Crypter, zeroOut bool) error {
-	fileMeta, ok := ix.fileMap[filename]
+	return ix.DeleteFileContext(context.Background(), filename, reader, writer, crypter, zeroOut)
+}
+
+// DeleteFileContext is DeleteFile, stopping if the context is cancelled while the file is being zeroed out
+func (ix *Index) DeleteFileContext(ctx context.Context, filename string, reader BlockReader, writer BlockWriter, crypter Crypter, zeroOut bool) error {
+	return ix.update(func(work *Index) error {
+		return work.deleteFile(ctx, filename, reader, writer, crypter, zeroOut)
+	})
+}
+
+func (ix *Index) deleteFile(ctx context.Context, filename string, reader BlockReader, writer BlockWriter, crypter Crypter, zeroOut bool) error {
+	fileMeta, ok := ix.lookupFile(filename)
 	if !ok {
 		return errors.New("file does not exist in the index")
 	}
-
-	var block *Block
-	var err error
-	if zeroOut {
-		block, err = ReadBlock(fileMeta.Blocks[0].Block, crypter, reader)
-		if err != nil {
-			return err
+	locations := ix.freedLocations(fileMeta)
+
+	// Find which blocks the file is on, and which of those only have this file on them (those don't need zeroing, as they'll be deleted)
+	_, canDelete := writer.(BlockDeleter)
+	touched := make([]string, 0)
+	remaining := make(map[string]int)
+	for _, loc := range locations {
+		if _, seen := remaining[loc.Block]; !seen {
+			touched = append(touched, loc.Block)
+			remaining[loc.Block] = len(ix.blockAllocation[loc.Block])
 		}
+		remaining[loc.Block]--
 	}
-	for _, allocation := range fileMeta.Blocks {
-		if zeroOut {
-			if block.Filename != allocation.Block {
-				err = WriteBlock(block, crypter, writer)
-				if err != nil {
-					return err
-				}
-				block, err = ReadBlock(allocation.Block, crypter, reader)
-				if err != nil {
-					return err
-				}
+	if zeroOut {
+		pool := newWorkerPool(ctx, ix.config.Concurrency)
+		for _, name := range touched {
+			if canDelete && remaining[name] == 0 {
+				continue
 			}
-
-			bytes := make([]byte, allocation.EndByte-allocation.StartByte)
-			block.Update(int(allocation.StartByte), bytes)
-		}
-
-		allocations := ix.blockAllocation[allocation.Block]
-		for idx, all := range allocations {
-			if all.Block == allocation.Block && all.StartByte == allocation.StartByte && all.EndByte == allocation.EndByte {
-				ix.blockAllocation[allocation.Block] = append(allocations[:idx], allocations[idx+1:]...)
-				break
+			if err := ix.zeroLocations(ctx, pool, name, locations, reader, writer, crypter); err != nil {
+				pool.wait()
+				return err
 			}
 		}
-	}
-	if zeroOut {
-		err = WriteBlock(block, crypter, writer)
-		if err != nil {
+		if err := pool.wait(); err != nil {
 			return err
 		}
 	}
 
-	delete(ix.fileMap, fileMeta.Filename)
+	for _, loc := range locations {
+		ix.removeBlockAllocation(loc)
+	}
+	ix.releaseChunks(fileMeta)
 	for i, f := range ix.files {
 		if f.Filename == fileMeta.Filename {
 			ix.files = append(ix.files[:i], ix.files[i+1:]...)
 			break
 		}
 	}
+	ix.reindexFiles()
 
+	ix.releaseEmptyBlocks(touched, writer)
 	return nil
 }
 
-func (ix *Index) nextBlock(curBlock string) (*BlockMetadata, bool) {
+// releaseEmptyBlocks unlinks any of the blocks which have no allocations left if the writer is a BlockDeleter,
+// and their files are deleted when the index is next saved. Blocks which can't be deleted are kept in the index so their space can be reused.
+// The number of blocks released is returned.
+func (ix *Index) releaseEmptyBlocks(names []string, writer BlockWriter) int {
+	if _, canDelete := writer.(BlockDeleter); !canDelete {
+		return 0
+	}
+
+	released := 0
+	for _, name := range names {
+		if _, exists := ix.blocks[name]; exists && len(ix.blockAllocation[name]) == 0 {
+			ix.supersede(ix.blockFilename(name))
+			ix.unlinkBlock(name)
+			released++
+		}
+	}
+	return released
+}
+
+// zeroLocations overwrites the bytes of any of the locations which are on the block with zeros.
+// The block is read, zeroed and written by the worker pool, but the index is updated straight away.
+func (ix *Index) zeroLocations(ctx context.Context, pool *workerPool, blockName string, locations []BlockLocation, reader BlockReader, writer BlockWriter, crypter Crypter) error {
+	current := ix.blockFilename(blockName)
+	filename := ix.blockWriteName(blockName, writer)
+	if filename != current {
+		if err := ix.logWrites(ctx, []string{filename}, writer, crypter); err != nil {
+			return err
+		}
+	}
+	ix.repointBlock(blockName, filename)
+
+	return pool.submit(func(ctx context.Context) error {
+		block, err := readBlock(ctx, current, crypter, reader)
+		if err != nil {
+			return err
+		}
+		for _, loc := range locations {
+			if loc.Block == blockName {
+				block.Update(int(loc.StartByte), make([]byte, loc.EndByte-loc.StartByte))
+			}
+		}
+		block.Filename = filename
+		return writeBlock(ctx, block, crypter, writer)
+	})
+}
+
+// removeBlockAllocation frees an allocation on a block
+func (ix *Index) removeBlockAllocation(loc BlockLocation) {
+	allocations := ix.blockAllocation[loc.Block]
+	for idx, allocation := range allocations {
+		if allocation.StartByte == loc.StartByte && allocation.EndByte == loc.EndByte {
+			ix.blockAllocation[loc.Block] = append(allocations[:idx], allocations[idx+1:]...)
+			return
+		}
+	}
+}
+
+// unlinkBlock removes a block from the index, joining the blocks before and after it in the chain
+func (ix *Index) unlinkBlock(name string) {
+	blockMeta := ix.blocks[name]
+	if ix.startBlock == name {
+		ix.startBlock = blockMeta.Next
+	} else {
+		for prevName, prev := range ix.blocks {
+			if prev.Next == name {
+				prev.Next = blockMeta.Next
+				ix.blocks[prevName] = prev
+				break
+			}
+		}
+	}
+	delete(ix.blocks, name)
+	delete(ix.blockAllocation, name)
+}
+
+func (ix *Index) nextBlock(curBlock string) (string, bool) {
 	if curBlock == "" {
 		newBlock := BlockMetadata{
 			Filename: getNextBlockName(""),
@@ -393,12 +719,11 @@ func (ix *Index) nextBlock(curBlock string) (*BlockMetadata, bool) {
 			Next:     "",
 		}
 		ix.blocks[newBlock.Filename] = newBlock
-		return &newBlock, true
+		return newBlock.Filename, true
 	}
 	curBlockMeta := ix.blocks[curBlock]
 	if curBlockMeta.Next != "" {
-		nextBlock := ix.blocks[curBlockMeta.Next]
-		return &nextBlock, false
+		return curBlockMeta.Next, false
 	}
 
 	curBlockMeta.Next = getNextBlockName(curBlock)
@@ -409,5 +734,63 @@ func (ix *Index) nextBlock(curBlock string) (*BlockMetadata, bool) {
 		Next:     "",
 	}
 	ix.blocks[newBlock.Filename] = newBlock
-	return &newBlock, true
+	return newBlock.Filename, true
+}
+
+// GC finds block files in the store which aren't referenced by the index, such as those left behind by a crash
+// between writing blocks and saving the index, and deletes them unless `dryRun` is true. The orphaned block names are returned.
+// Only names which look like blocks are considered, so the index and other files in the store are never touched.
+// GC must not run while another process is adding files to the store, as their new blocks aren't in this index yet; see LockStore.
+// Other goroutines may change the index while GC runs; it waits for their changes to finish.
+// An index loaded from a snapshot doesn't reference blocks written since, so GC refuses to run on one, returning ErrReadOnlyIndex.
+func (ix *Index) GC(lister BlockLister, deleter BlockDeleter, dryRun bool) ([]string, error) {
+	return ix.GCContext(context.Background(), lister, deleter, dryRun)
+}
+
+// GCContext is GC, stopping if the context is cancelled before the blocks are listed, or between deleting them.
+// The orphans found are returned with the context's error, as with any other error deleting them.
+func (ix *Index) GCContext(ctx context.Context, lister BlockLister, deleter BlockDeleter, dryRun bool) ([]string, error) {
+	ix.writeLock.Lock()
+	defer ix.writeLock.Unlock()
+	if ix.readOnly {
+		return nil, ErrReadOnlyIndex
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	names, err := lister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files superseded since the index was saved are still referenced by the saved index
+	live := ix.referencedBlockFiles()
+	for _, filename := range ix.superseded {
+		live[filename] = true
+	}
+
+	orphans := make([]string, 0)
+	for _, name := range names {
+		if isBlockName(name) && !live[name] && name != ix.config.IndexFile && name != ix.config.HeaderFile && name != ix.config.JournalFile {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+
+	if dryRun {
+		return orphans, nil
+	}
+	if deleter == nil {
+		return orphans, errors.New("a BlockDeleter is required to delete orphaned blocks")
+	}
+	for _, name := range orphans {
+		err := ctx.Err()
+		if err == nil {
+			err = deleter.Delete(name)
+		}
+		if err != nil {
+			return orphans, err
+		}
+	}
+	return orphans, nil
 }
@@ -0,0 +1,480 @@
+package enstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore is an in-memory IndexReader/IndexWriter which counts the bytes read from it
+type testStore struct {
+	lock      sync.Mutex
+	files     map[string][]byte
+	bytesRead int
+}
+
+func newTestStore() *testStore {
+	return &testStore{files: make(map[string][]byte)}
+}
+
+func (s *testStore) Read(name string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	s.bytesRead += len(data)
+	return append([]byte{}, data...), nil
+}
+
+func (s *testStore) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	end := offset + int64(length)
+	if end > int64(len(data)) {
+		s.bytesRead += len(data) - int(offset)
+		return append([]byte{}, data[offset:]...), io.EOF
+	}
+	s.bytesRead += length
+	return append([]byte{}, data[offset:end]...), nil
+}
+
+func (s *testStore) Write(name string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *testStore) Exists(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.files[name]
+	return ok
+}
+
+func (s *testStore) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *testStore) List() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// writeOnlyStore hides everything but Write from its testStore
+type writeOnlyStore struct {
+	store *testStore
+}
+
+func (s *writeOnlyStore) Write(name string, data []byte) error {
+	return s.store.Write(name, data)
+}
+
+// testFile is an in-memory File
+type testFile struct {
+	*bytes.Reader
+	name string
+}
+
+func newTestFile(name string, contents []byte) *testFile {
+	return &testFile{bytes.NewReader(contents), name}
+}
+
+func (f *testFile) Name() string {
+	return f.name
+}
+
+// testContents returns `size` bytes of non-repeating-ish content
+func testContents(size int) []byte {
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i*7 + i/251)
+	}
+	return contents
+}
+
+func newTestIndex(t *testing.T) (*Index, *testStore, Crypter) {
+	cfg := NewDefaultConfig()
+	cfg.BlockSize = 4096
+	cfg.ChunkSize = 64
+	crypter, err := NewAEADCrypter(good32ByteKey, AlgorithmAESGCM, false)
+	assert.Nil(t, err)
+	crypter.segmentSize = 256
+	return NewIndex(cfg), newTestStore(), crypter
+}
+
+func TestGetFile(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	small := testContents(100)
+	large := testContents(10000)
+	assert.Nil(t, ix.AddFile(newTestFile("small", small), store, store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("large", large), store, store, crypter))
+
+	for name, contents := range map[string][]byte{"small": small, "large": large} {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			assert.Nil(t, ix.GetFile(name, buf, store, crypter))
+			assert.Equal(t, contents, buf.Bytes())
+		})
+	}
+
+	err := ix.GetFile("missing", &bytes.Buffer{}, store, crypter)
+	assert.Equal(t, errors.New("file does not exist in the index"), err)
+}
+
+type failingWriter struct{}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("I AM ERROR")
+}
+
+func TestGetFileWriteError(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("file", testContents(100)), store, store, crypter))
+
+	err := ix.GetFile("file", &failingWriter{}, store, crypter)
+	assert.Equal(t, errors.New("I AM ERROR"), err)
+}
+
+// assertFileContents checks that a file in the index can be read back with the expected contents
+func assertFileContents(t *testing.T, ix *Index, name string, expected []byte, reader BlockReader, crypter Crypter) {
+	buf := &bytes.Buffer{}
+	if assert.Nil(t, ix.GetFile(name, buf, reader, crypter), name) {
+		assert.Equal(t, expected, buf.Bytes(), name)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(1500)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Equal(t, 1, len(ix.blocks))
+	block := ix.startBlock
+	saved := ix.blockFilename(block)
+
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// The block still has b on it, so is kept, but a is zeroed out in a copy of it, which replaces it once the index is saved
+	before := append([]byte{}, store.files[saved]...)
+	assert.Nil(t, ix.DeleteFile("a", store, store, crypter, true))
+	copied := ix.blocks[block].Filename
+	assert.NotEqual(t, saved, copied)
+	assert.Equal(t, before, store.files[saved])
+	assertFileContents(t, ix, "b", b, store, crypter)
+	assert.Equal(t, 1, len(ix.ListFiles()))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.False(t, store.Exists(saved))
+	assert.True(t, store.Exists(copied))
+	zeroed, err := ReadBlock(copied, crypter, store)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 1000), zeroed.Bytes[:1000])
+
+	// Nothing is left on the block, so it is deleted once the index is saved
+	assert.Nil(t, ix.DeleteFile("b", store, store, crypter, true))
+	assert.True(t, store.Exists(copied))
+	assert.Equal(t, 0, len(ix.blocks))
+	assert.Equal(t, "", ix.startBlock)
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.False(t, store.Exists(copied))
+
+	err = ix.DeleteFile("b", store, store, crypter, true)
+	assert.Equal(t, errors.New("file does not exist in the index"), err)
+
+	// A file can be added to the now empty index
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assertFileContents(t, ix, "a", a, store, crypter)
+}
+
+func TestDeleteFileUnlinksBlocks(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	files := map[string][]byte{"x": testContents(4096), "y": testContents(4096), "z": testContents(4096)}
+	for _, name := range []string{"x", "y", "z"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, files[name]), store, store, crypter))
+	}
+	first := ix.startBlock
+	second := ix.blocks[first].Next
+	third := ix.blocks[second].Next
+
+	assert.Nil(t, ix.DeleteFile("y", store, store, crypter, false))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.False(t, store.Exists(second))
+	assert.Equal(t, third, ix.blocks[first].Next)
+	_, ok := ix.blocks[second]
+	assert.False(t, ok)
+
+	assert.Nil(t, ix.DeleteFile("x", store, store, crypter, false))
+	assert.Equal(t, third, ix.startBlock)
+
+	// New blocks are added onto the end of the remaining chain
+	w := testContents(5000)
+	assert.Nil(t, ix.AddFile(newTestFile("w", w), store, store, crypter))
+	assert.Equal(t, 3, len(ix.blocks))
+	assertFileContents(t, ix, "z", files["z"], store, crypter)
+	assertFileContents(t, ix, "w", w, store, crypter)
+}
+
+func TestDeleteFileWithoutDeleter(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(100)), store, store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("empty", []byte{}), store, store, crypter))
+	block := ix.startBlock
+
+	// If blocks can't be deleted, they are kept in the index to be reused
+	assert.Nil(t, ix.DeleteFile("a", store, &writeOnlyStore{store}, crypter, true))
+	assert.True(t, store.Exists(block))
+	assert.Equal(t, block, ix.startBlock)
+
+	assert.Nil(t, ix.DeleteFile("empty", store, store, crypter, true))
+	assert.Equal(t, 0, len(ix.ListFiles()))
+}
+
+func TestAddFileExists(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a := testContents(1000)
+	assert.Nil(t, ix.AddFile(newTestFile("dir/a", a), store, store, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFile(newTestFile("./dir/a", testContents(10)), store, store, crypter))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+	assertFileContents(t, ix, "dir/a", a, store, crypter)
+
+	// A file can't be added where there's a directory, or under a file
+	assert.Equal(t, ErrFileExists, ix.AddFile(newTestFile("dir", testContents(10)), store, store, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFile(newTestFile("dir/a/b", testContents(10)), store, store, crypter))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+
+	// Names stored before they were normalized still clash
+	ix.files[0].Filename = "./dir//a"
+	ix.reindexFiles()
+	assert.Equal(t, ErrFileExists, ix.AddFile(newTestFile("dir/a", testContents(10)), store, store, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFile(newTestFile("dir", testContents(10)), store, store, crypter))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+}
+
+func TestReplaceFile(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	b := testContents(1000)
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(6000)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.Equal(t, 2, len(ix.blocks))
+	before := storeContents(store)
+
+	// The new contents fit in the space the old ones used, and the block that's left empty is released
+	replacement := randomContents(3000, 1)
+	assert.Nil(t, ix.ReplaceFile(newTestFile("a", replacement), store, store, crypter))
+	assert.Equal(t, 2, len(ix.ListFiles()))
+	assert.Equal(t, 1, len(ix.blocks))
+	assert.Equal(t, int64(4000), allocatedBytes(ix))
+	assertFileContents(t, ix, "a", replacement, store, crypter)
+	assertFileContents(t, ix, "b", b, store, crypter)
+
+	// Until the index is saved, the store still holds the old contents
+	loaded, err := readIndex(context.Background(), store, ix.config.IndexFile, crypter, ix.config)
+	assert.Nil(t, err)
+	assertFileContents(t, loaded, "a", testContents(6000), store, crypter)
+	for name, data := range before {
+		if name != ix.config.JournalFile {
+			assert.Equal(t, data, store.files[name], name)
+		}
+	}
+
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err = LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assertFileContents(t, loaded, "a", replacement, store, crypter)
+	assert.ElementsMatch(t, []string{ix.config.IndexFile, ix.blockFilename(ix.startBlock)}, storeNames(store))
+
+	// A file which isn't in the index is added
+	assert.Nil(t, ix.ReplaceFile(newTestFile("c", b), store, store, crypter))
+	assertFileContents(t, ix, "c", b, store, crypter)
+}
+
+// failingWriteStore is a writeOnlyStore whose writes fail after the first `writes`
+type failingWriteStore struct {
+	store  *testStore
+	lock   sync.Mutex
+	writes int
+}
+
+func (s *failingWriteStore) Write(name string, data []byte) error {
+	s.lock.Lock()
+	if s.writes == 0 {
+		s.lock.Unlock()
+		return errors.New("write failed")
+	}
+	s.writes--
+	s.lock.Unlock()
+	return s.store.Write(name, data)
+}
+
+func TestReplaceFileWriteOnlyFails(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	b := testContents(1000)
+	a := testContents(6000)
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// Blocks are overwritten in place, so the new contents mustn't be written over the old ones before they've all been written
+	writer := &failingWriteStore{store: store, writes: 1}
+	assert.NotNil(t, ix.ReplaceFile(newTestFile("a", randomContents(5000, 1)), store, writer, crypter))
+	assertFileContents(t, ix, "a", a, store, crypter)
+	assertFileContents(t, ix, "b", b, store, crypter)
+
+	// Once the new contents are written, the old space is freed
+	replacement := randomContents(5000, 2)
+	assert.Nil(t, ix.ReplaceFile(newTestFile("a", replacement), store, &writeOnlyStore{store}, crypter))
+	assertFileContents(t, ix, "a", replacement, store, crypter)
+	assertFileContents(t, ix, "b", b, store, crypter)
+	assert.Equal(t, int64(6000), allocatedBytes(ix))
+}
+
+func TestReplaceDedupFile(t *testing.T) {
+	ix, store, crypter := newDedupTestIndex(t)
+	original := randomContents(20000, 1)
+	assert.Nil(t, ix.AddFile(newTestFile("a", original), store, store, crypter))
+	used := allocatedBytes(ix)
+
+	// Only the changed chunks are written, and the ones only the old version used are freed
+	changed := append([]byte{}, original...)
+	copy(changed[10000:], randomContents(100, 2))
+	assert.Nil(t, ix.ReplaceFile(newTestFile("a", changed), store, store, crypter))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+	assertFileContents(t, ix, "a", changed, store, crypter)
+	assert.InDelta(t, used, allocatedBytes(ix), 8192)
+	refs := 0
+	for _, chunk := range ix.chunks {
+		refs += chunk.RefCount
+	}
+	assert.Equal(t, len(ix.files[0].Chunks), refs)
+}
+
+// countingStore is a testStore which counts how many times each file is written
+type countingStore struct {
+	*testStore
+	writesLock sync.Mutex
+	writes     map[string]int
+}
+
+func (s *countingStore) Write(name string, data []byte) error {
+	s.writesLock.Lock()
+	s.writes[name]++
+	s.writesLock.Unlock()
+	return s.testStore.Write(name, data)
+}
+
+func TestAddFiles(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("existing", testContents(1000)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	files := make([]File, 0)
+	contents := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("dir/%d", i)
+		contents[name] = randomContents(300+i*10, int64(i))
+		files = append(files, newTestFile(name, contents[name]))
+	}
+
+	// Nothing is written if any of the names clash
+	counting := &countingStore{testStore: store, writes: make(map[string]int)}
+	clashing := append([]File{newTestFile("dir/0", nil)}, files...)
+	assert.Equal(t, ErrFileExists, ix.AddFiles(clashing, counting, counting, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFiles(append(files, newTestFile("existing", nil)), counting, counting, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFiles(append(files, newTestFile("dir", nil)), counting, counting, crypter))
+	assert.Equal(t, ErrFileExists, ix.AddFiles(append([]File{newTestFile("dir/0/x", nil)}, files...), counting, counting, crypter))
+	assert.Equal(t, 0, len(counting.writes))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+
+	// The files fill several blocks, and each block is written once
+	assert.Nil(t, ix.AddFiles(files, counting, counting, crypter))
+	assert.True(t, len(ix.blocks) > 3)
+	for name, count := range counting.writes {
+		if name != ix.config.JournalFile {
+			assert.Equal(t, 1, count, name)
+		}
+	}
+	assert.Equal(t, len(ix.blocks), len(counting.writes)-1)
+
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, 51, len(loaded.ListFiles()))
+	for name, data := range contents {
+		assertFileContents(t, loaded, name, data, store, crypter)
+	}
+	assertFileContents(t, loaded, "existing", testContents(1000), store, crypter)
+}
+
+func TestGC(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(5000)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	live := []string{ix.startBlock, ix.blocks[ix.startBlock].Next}
+
+	// An orphaned block, and a file which isn't a block
+	orphan := getNextBlockName("")
+	store.Write(orphan, []byte("orphan"))
+	store.Write("notes.txt", []byte("not a block"))
+
+	orphans, err := ix.GC(store, store, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{orphan}, orphans)
+	assert.True(t, store.Exists(orphan))
+
+	_, err = ix.GC(store, nil, false)
+	assert.NotNil(t, err)
+	assert.True(t, store.Exists(orphan))
+
+	orphans, err = ix.GC(store, store, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{orphan}, orphans)
+	assert.False(t, store.Exists(orphan))
+	for _, name := range append(live, ix.config.IndexFile, "notes.txt") {
+		assert.True(t, store.Exists(name), name)
+	}
+
+	orphans, err = ix.GC(store, store, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orphans))
+}
+
+func TestGCSnapshotIndex(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(1000)), store, store, crypter))
+	assert.Nil(t, ix.Snapshot("v1", store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("b", testContents(5000)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	names := storeNames(store)
+
+	// The snapshot doesn't reference the blocks written since, which mustn't be mistaken for orphans
+	v1, err := LoadIndexAt(store, crypter, ix.config, "v1")
+	assert.Nil(t, err)
+	orphans, err := v1.GC(store, store, true)
+	assert.Equal(t, ErrReadOnlyIndex, err)
+	assert.Equal(t, 0, len(orphans))
+	_, err = v1.GC(store, store, false)
+	assert.Equal(t, ErrReadOnlyIndex, err)
+	assert.Equal(t, names, storeNames(store))
+	assertFileContents(t, ix, "b", testContents(5000), store, crypter)
+}
@@ -0,0 +1,175 @@
+package enstore
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// journal lists the block files written and superseded since the index was last saved.
+// Blocks are never modified in place while the saved index references them; changes are written to new files instead (copy-on-write),
+// and the saved index is only replaced once everything it needs has been written. The journal is written before any new block files,
+// so if the process stops part way through, LoadIndex can tell which files belong to a commit that never happened and which were
+// left behind by one which did.
+//
+// Blocks are keyed by a name which stays the same for the life of the block, while the file the block is stored in (BlockMetadata.Filename)
+// changes each time it's modified. Index.Save commits the changes made since the index was last saved: the journal is saved first,
+// then the index replaces the old one, and then, if the writer is a BlockDeleter, the block files the index no longer references
+// (including any abandoned by an interrupted commit) and the journal are deleted. Once the index is written the commit has happened,
+// even if the save is cancelled or fails after that; the files left to delete are deleted when the index is next saved.
+// Files being read while the index is saved may fail to read if they're on blocks changed since it was last saved, as their files are deleted.
+type journal struct {
+	// Generation is the generation of the saved index the changes were made to
+	Generation int64
+	Written    []string
+	Superseded []string
+}
+
+// blockFilename returns the name of the file a block is currently stored in
+func (ix *Index) blockFilename(name string) string {
+	return ix.blocks[name].Filename
+}
+
+// blockFileLocations returns a copy of the locations with each block replaced by the name of the file it's currently stored in
+func (ix *Index) blockFileLocations(locations []BlockLocation) []BlockLocation {
+	fileLocations := make([]BlockLocation, len(locations))
+	for i, loc := range locations {
+		fileLocations[i] = loc
+		fileLocations[i].Block = ix.blockFilename(loc.Block)
+	}
+	return fileLocations
+}
+
+// blockWriteName returns the name of the file a modified block should be written to.
+// Blocks written by the change being made are overwritten; readers of the index can't see those yet. Otherwise, if the writer is a BlockDeleter,
+// the block is copied to a new file, and the old one deleted once the index is saved. If the writer can't delete blocks, the old file could
+// never be removed, so the block is overwritten in place, which isn't crash-safe, or safe to read while it's written.
+// Blocks a snapshot references are always copied.
+func (ix *Index) blockWriteName(name string, writer BlockWriter) string {
+	filename := ix.blockFilename(name)
+	if ix.protected[filename] {
+		return getNextBlockName("")
+	}
+	if ix.writing[filename] {
+		return filename
+	}
+	if _, ok := writer.(BlockDeleter); ok {
+		return getNextBlockName("")
+	}
+	return filename
+}
+
+// logWrites adds block files which are about to be written to the journal, and saves it
+func (ix *Index) logWrites(ctx context.Context, filenames []string, writer BlockWriter, crypter Crypter) error {
+	logged := false
+	for _, filename := range filenames {
+		if filename != "" {
+			ix.writing[filename] = true
+		}
+		if !ix.written[filename] && filename != "" {
+			ix.written[filename] = true
+			logged = true
+		}
+	}
+	if !logged {
+		return nil
+	}
+	return ix.writeJournal(ctx, writer, crypter)
+}
+
+// repointBlock points the index to the file a block has been (or is being) written to, superseding the file it was stored in
+func (ix *Index) repointBlock(name, filename string) {
+	blockMeta := ix.blocks[name]
+	if blockMeta.Filename != filename {
+		ix.supersede(blockMeta.Filename)
+		blockMeta.Filename = filename
+		ix.blocks[name] = blockMeta
+	}
+}
+
+// supersede marks a file to be deleted once the index is saved, unless a snapshot references it
+func (ix *Index) supersede(filename string) {
+	if !ix.protected[filename] {
+		ix.superseded = append(ix.superseded, filename)
+	}
+}
+
+// hasPendingChanges returns true if block files have been written or superseded since the index was saved,
+// or were abandoned by an interrupted commit
+func (ix *Index) hasPendingChanges() bool {
+	return len(ix.written) > 0 || len(ix.superseded) > 0 || len(ix.abandoned) > 0
+}
+
+// writeJournal encrypts and saves the journal.
+// Files abandoned by an interrupted commit are listed as both written and superseded, so they're deleted whether or not this one happens.
+func (ix *Index) writeJournal(ctx context.Context, writer BlockWriter, crypter Crypter) error {
+	j := journal{
+		Generation: ix.generation,
+		Written:    make([]string, 0, len(ix.written)+len(ix.abandoned)),
+		Superseded: append(append([]string{}, ix.superseded...), ix.abandoned...),
+	}
+	for filename := range ix.written {
+		j.Written = append(j.Written, filename)
+	}
+	j.Written = append(j.Written, ix.abandoned...)
+	sort.Strings(j.Written)
+
+	jsonBytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	data, err := crypter.Encrypt(jsonBytes)
+	if err != nil {
+		return err
+	}
+	return writeContext(ctx, writer, ix.config.JournalFile, data)
+}
+
+// readJournal finds the block files abandoned by an interrupted commit, if a journal was left behind by one.
+// If the index was saved, they're the block files it superseded, otherwise they're the block files written for it.
+// Files the index references are never abandoned. Nothing is deleted here: the journal may belong to a change another process
+// is still making, whose new blocks the saved index doesn't reference yet. Instead, the abandoned files are deleted when the index
+// is next saved, or by GC, which should only be done while holding the store lock (see LockStore).
+func (ix *Index) readJournal(ctx context.Context, reader IndexReader, crypter Crypter) error {
+	exists, err := FileExists(reader, ix.config.JournalFile)
+	if err != nil || !exists {
+		return err
+	}
+
+	var j journal
+	data, err := readContext(ctx, reader, ix.config.JournalFile)
+	if err != nil {
+		return err
+	}
+	decrypted, err := crypter.Decrypt(data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(decrypted, &j); err != nil {
+		return err
+	}
+
+	stale := j.Written
+	if ix.generation > j.Generation {
+		stale = j.Superseded
+	}
+	live := ix.referencedBlockFiles()
+	for _, filename := range stale {
+		if !live[filename] {
+			ix.abandoned = append(ix.abandoned, filename)
+		}
+	}
+	return nil
+}
+
+// referencedBlockFiles returns the names of all the block files the index or its snapshots reference
+func (ix *Index) referencedBlockFiles() map[string]bool {
+	live := make(map[string]bool, len(ix.blocks)+len(ix.protected))
+	for _, blockMeta := range ix.blocks {
+		live[blockMeta.Filename] = true
+	}
+	for filename := range ix.protected {
+		live[filename] = true
+	}
+	return live
+}
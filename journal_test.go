@@ -0,0 +1,189 @@
+package enstore
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readOnlyStore hides everything but Read and Exists from its testStore
+type readOnlyStore struct {
+	store *testStore
+}
+
+func (s *readOnlyStore) Read(name string) ([]byte, error) {
+	return s.store.Read(name)
+}
+
+func (s *readOnlyStore) Exists(name string) bool {
+	return s.store.Exists(name)
+}
+
+// failingDeleteStore is a testStore which can't delete anything
+type failingDeleteStore struct {
+	*testStore
+}
+
+func (s *failingDeleteStore) Delete(name string) error {
+	return errors.New("delete failed")
+}
+
+func storeContents(store *testStore) map[string][]byte {
+	contents := make(map[string][]byte, len(store.files))
+	for name, data := range store.files {
+		contents[name] = append([]byte{}, data...)
+	}
+	return contents
+}
+
+func storeNames(store *testStore) []string {
+	names, _ := store.List()
+	sort.Strings(names)
+	return names
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(2000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	saved := storeContents(store)
+
+	// Nothing the saved index uses is changed until the index is saved again
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Nil(t, ix.DeleteFile("a", store, store, crypter, true))
+	for name, data := range saved {
+		if name != ix.config.IndexFile {
+			assert.Equal(t, data, store.files[name], name)
+		}
+	}
+	assert.True(t, store.Exists(ix.config.JournalFile))
+
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.False(t, store.Exists(ix.config.JournalFile))
+	assert.Equal(t, []string{ix.blocks[ix.startBlock].Filename, ix.config.IndexFile}, storeNames(store))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assertFileContents(t, loaded, "b", b, store, crypter)
+	assert.Equal(t, int64(2), loaded.generation)
+}
+
+func TestLoadIndexRollsBack(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a := testContents(1000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	saved := storeNames(store)
+
+	// Changes which were never saved are thrown away, along with any blocks written for them
+	assert.Nil(t, ix.AddFile(newTestFile("b", testContents(6000)), store, store, crypter))
+	assert.Nil(t, ix.DeleteFile("a", store, store, crypter, true))
+	assert.NotEqual(t, saved, storeNames(store))
+
+	// Loading doesn't change the store; they're deleted once the loaded index is saved
+	unsaved := storeNames(store)
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, unsaved, storeNames(store))
+	assert.Equal(t, 1, len(loaded.ListFiles()))
+	assertFileContents(t, loaded, "a", a, store, crypter)
+	assert.Nil(t, loaded.Save(store, crypter))
+	assert.Equal(t, saved, storeNames(store))
+	assertFileContents(t, loaded, "a", a, store, crypter)
+
+	// Blocks written for a new store are thrown away too
+	ix, store, crypter = newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	loaded, err = LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(loaded.ListFiles()))
+	assert.Nil(t, loaded.Save(store, crypter))
+	assert.Equal(t, []string{ix.config.IndexFile}, storeNames(store))
+}
+
+func TestLoadIndexRollsForward(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(2000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	old := ix.blocks[ix.startBlock].Filename
+
+	// The index is saved, but stops before the superseded block is deleted
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.NotNil(t, ix.Save(&failingDeleteStore{store}, crypter))
+	assert.True(t, store.Exists(old))
+	assert.True(t, store.Exists(ix.config.JournalFile))
+
+	// The superseded block is deleted by the next Save, not when the index is loaded
+	loaded, err := LoadIndex(&readOnlyStore{store}, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.True(t, store.Exists(old))
+	assert.Equal(t, []string{old}, loaded.abandoned)
+
+	loaded, err = LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.True(t, store.Exists(old))
+	assert.True(t, store.Exists(ix.config.JournalFile))
+	assert.Nil(t, loaded.Save(store, crypter))
+	assert.False(t, store.Exists(old))
+	assert.False(t, store.Exists(ix.config.JournalFile))
+	assert.Equal(t, []string{loaded.blocks[loaded.startBlock].Filename, ix.config.IndexFile}, storeNames(store))
+	assertFileContents(t, loaded, "a", a, store, crypter)
+	assertFileContents(t, loaded, "b", b, store, crypter)
+}
+
+func TestLoadIndexDuringChange(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(6000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// Another process loading the index while a change is being made, before it's saved, mustn't delete the change's new blocks
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	during := storeNames(store)
+	reader, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, during, storeNames(store))
+	assertFileContents(t, reader, "a", a, store, crypter)
+
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assertFileContents(t, loaded, "a", a, store, crypter)
+	assertFileContents(t, loaded, "b", b, store, crypter)
+}
+
+func TestGCDeletesAbandonedBlocks(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(1000)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	saved := storeNames(store)
+	assert.Nil(t, ix.AddFile(newTestFile("b", testContents(6000)), store, store, crypter))
+
+	// Blocks written for a change which was never saved are orphans
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	orphans, err := loaded.GC(store, store, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(loaded.abandoned), len(orphans))
+	assert.Nil(t, loaded.Save(store, crypter))
+	assert.Equal(t, saved, storeNames(store))
+}
+
+func TestAddFileAfterCopyOnWrite(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	files := map[string][]byte{"a": testContents(1000), "b": testContents(1000)[10:], "c": testContents(3000)[20:]}
+	assert.Nil(t, ix.AddFile(newTestFile("a", files["a"]), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// Once a block has been copied, it's still found by its name in the index
+	assert.Nil(t, ix.AddFile(newTestFile("b", files["b"]), store, store, crypter))
+	assert.NotEqual(t, ix.startBlock, ix.blocks[ix.startBlock].Filename)
+	assert.Nil(t, ix.AddFile(newTestFile("c", files["c"]), store, store, crypter))
+	assert.Equal(t, 2, len(ix.blocks))
+	for name, contents := range files {
+		assertFileContents(t, ix, name, contents, store, crypter)
+	}
+}
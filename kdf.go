@@ -0,0 +1,161 @@
+package enstore
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFArgon2id derives keys with Argon2id
+	KDFArgon2id string = "argon2id"
+	// KDFScrypt derives keys with scrypt
+	KDFScrypt string = "scrypt"
+
+	// storeHeaderVersion is the current version of the store header format
+	storeHeaderVersion int = 1
+	// saltSize is the size of a newly generated salt (in bytes)
+	saltSize int = 32
+	// derivedKeySize is the size of keys derived from a passphrase (AES-256 / XChaCha20 key size)
+	derivedKeySize int = 32
+)
+
+var (
+	// ErrUnsupportedKDF is returned when KDFParams name an unknown key derivation function
+	ErrUnsupportedKDF = errors.New("unsupported key derivation function")
+	// ErrInvalidKDFParams is returned when KDFParams are missing required parameters
+	ErrInvalidKDFParams = errors.New("invalid key derivation parameters")
+)
+
+// KDFParams are the tunable parameters of a password-based key derivation function.
+// Only the parameters of the selected Algorithm are used.
+type KDFParams struct {
+	Algorithm string
+	// Argon2id iterations, memory (in KiB) and parallelism
+	Time    uint32 `json:",omitempty"`
+	Memory  uint32 `json:",omitempty"`
+	Threads uint8  `json:",omitempty"`
+	// scrypt CPU/memory cost, block size and parallelism
+	N int `json:",omitempty"`
+	R int `json:",omitempty"`
+	P int `json:",omitempty"`
+}
+
+// DefaultKDFParams returns the default key derivation parameters (Argon2id, 3 passes over 64 MiB with 4 threads)
+func DefaultKDFParams() KDFParams {
+	return KDFParams{
+		Algorithm: KDFArgon2id,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}
+}
+
+// Validate returns an error if the params name an unknown algorithm or are missing parameters it requires
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+			return ErrInvalidKDFParams
+		}
+	case KDFScrypt:
+		// N must be a power of two greater than 1
+		if p.N <= 1 || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 {
+			return ErrInvalidKDFParams
+		}
+	default:
+		return ErrUnsupportedKDF
+	}
+	return nil
+}
+
+// DeriveKey derives a key of `keyLength` bytes from the passphrase and salt
+func DeriveKey(passphrase, salt []byte, params KDFParams, keyLength int) ([]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	switch params.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, uint32(keyLength)), nil
+	case KDFScrypt:
+		return scrypt.Key(passphrase, salt, params.N, params.R, params.P, keyLength)
+	}
+	return nil, ErrUnsupportedKDF
+}
+
+// StoreHeader is the plaintext header stored alongside the index. It contains everything needed to turn a passphrase
+// into the store's key (but nothing secret), and the algorithm new data is encrypted with.
+type StoreHeader struct {
+	Version   int
+	KDF       KDFParams
+	Salt      []byte
+	Algorithm Algorithm
+}
+
+// NewStoreHeader returns a new StoreHeader with a freshly generated salt
+func NewStoreHeader(params KDFParams, algorithm Algorithm) (*StoreHeader, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &StoreHeader{
+		Version:   storeHeaderVersion,
+		KDF:       params,
+		Salt:      salt,
+		Algorithm: algorithm,
+	}, nil
+}
+
+// LoadStoreHeader will attempt to load an existing store header. If no header exists,
+// it will create a new one using the KDF parameters in the config. New headers must be saved by the caller.
+func LoadStoreHeader(reader IndexReader, cfg *Config) (*StoreHeader, error) {
+	exists, err := FileExists(reader, cfg.HeaderFile)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return NewStoreHeader(cfg.KDF, AlgorithmAESGCM)
+	}
+
+	data, err := reader.Read(cfg.HeaderFile)
+	if err != nil {
+		return nil, err
+	}
+	header := &StoreHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, err
+	}
+	if header.Version != storeHeaderVersion {
+		return nil, errors.New("unsupported store header version")
+	}
+	if len(header.Salt) == 0 {
+		return nil, errors.New("store header has no salt")
+	}
+	return header, header.KDF.Validate()
+}
+
+// Save writes the (unencrypted) header using the IndexWriter
+func (h *StoreHeader) Save(writer IndexWriter, cfg *Config) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writer.Write(cfg.HeaderFile, data)
+}
+
+// NewCrypterFromPassphrase derives the store key from the passphrase using the header's KDF parameters and salt,
+// and returns a Crypter for it. Stores with a header never contain legacy ciphertext, so none will be accepted.
+func NewCrypterFromPassphrase(passphrase []byte, header *StoreHeader) (Crypter, error) {
+	key, err := DeriveKey(passphrase, header.Salt, header.KDF, derivedKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADCrypter(key, header.Algorithm, false)
+}
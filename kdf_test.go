@@ -0,0 +1,96 @@
+package enstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Cheap parameters, so tests don't spend their time deriving keys
+var (
+	testArgon2idParams = KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+	testScryptParams   = KDFParams{Algorithm: KDFScrypt, N: 16, R: 1, P: 1}
+)
+
+func TestKDFParamsValidate(t *testing.T) {
+	tests := []struct {
+		testname      string
+		params        KDFParams
+		expectedError error
+	}{
+		{"Default", DefaultKDFParams(), nil},
+		{"Argon2id", testArgon2idParams, nil},
+		{"scrypt", testScryptParams, nil},
+		{"Unknown algorithm", KDFParams{Algorithm: "md5"}, ErrUnsupportedKDF},
+		{"Argon2id missing memory", KDFParams{Algorithm: KDFArgon2id, Time: 1, Threads: 1}, ErrInvalidKDFParams},
+		{"scrypt N not a power of two", KDFParams{Algorithm: KDFScrypt, N: 15, R: 1, P: 1}, ErrInvalidKDFParams},
+		{"scrypt missing P", KDFParams{Algorithm: KDFScrypt, N: 16, R: 1}, ErrInvalidKDFParams},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testname, func(t *testing.T) {
+			assert.Equal(t, test.expectedError, test.params.Validate())
+		})
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	salt := []byte("salt")
+
+	for _, params := range []KDFParams{testArgon2idParams, testScryptParams} {
+		t.Run(params.Algorithm, func(t *testing.T) {
+			key, err := DeriveKey(passphrase, salt, params, derivedKeySize)
+			assert.Nil(t, err)
+			assert.Equal(t, derivedKeySize, len(key))
+
+			same, _ := DeriveKey(passphrase, salt, params, derivedKeySize)
+			assert.Equal(t, key, same)
+
+			otherSalt, _ := DeriveKey(passphrase, []byte("pepper"), params, derivedKeySize)
+			assert.NotEqual(t, key, otherSalt)
+
+			otherPassphrase, _ := DeriveKey([]byte("Tr0ub4dor&3"), salt, params, derivedKeySize)
+			assert.NotEqual(t, key, otherPassphrase)
+		})
+	}
+}
+
+func TestStoreHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &LocalFileReadWriter{BasePath: dir}
+	cfg := NewDefaultConfig()
+	cfg.KDF = testArgon2idParams
+
+	// No header exists yet, so a new one is created with a random salt
+	header, err := LoadStoreHeader(store, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, testArgon2idParams, header.KDF)
+	assert.Equal(t, saltSize, len(header.Salt))
+	other, _ := LoadStoreHeader(store, cfg)
+	assert.NotEqual(t, header.Salt, other.Salt)
+
+	assert.Nil(t, header.Save(store, cfg))
+	loaded, err := LoadStoreHeader(store, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, header, loaded)
+
+	// Crypters derived from the same passphrase and header can read each others' ciphertext
+	c1, err := NewCrypterFromPassphrase([]byte("passphrase"), header)
+	assert.Nil(t, err)
+	c2, err := NewCrypterFromPassphrase([]byte("passphrase"), loaded)
+	assert.Nil(t, err)
+	encrypted, _ := c1.Encrypt([]byte("I AM CONTENT"))
+	decrypted, err := c2.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("I AM CONTENT"), decrypted)
+
+	wrong, _ := NewCrypterFromPassphrase([]byte("wrong passphrase"), loaded)
+	_, err = wrong.Decrypt(encrypted)
+	assert.Equal(t, ErrAuthenticationFailed, err)
+}
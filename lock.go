@@ -0,0 +1,173 @@
+package enstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// ErrIndexChanged is returned by Save when another process has saved the index since it was loaded (or last saved by this process).
+// Saving would discard the other process's changes, so nothing is written; load the index again and make the changes to that instead.
+var ErrIndexChanged = errors.New("the index in the store has been changed by another process since it was loaded")
+
+// ErrWriteConflict is returned by a ConditionalWriter when the file isn't at the version the write was conditional on
+var ErrWriteConflict = errors.New("the file has been changed since it was read")
+
+// ConditionalWriter is implemented by backends which can make a write conditional on the file not having changed, such as with HTTP If-Match.
+// ReadVersion reads a file along with its version (an ETag, for example), which is "" if the backend doesn't report one.
+// If the file doesn't exist, the data is nil and there's no error.
+// WriteIfVersion writes a file only if it's still at `version`, or if `version` is "" only if it doesn't exist,
+// and returns ErrWriteConflict otherwise.
+type ConditionalWriter interface {
+	ReadVersion(ctx context.Context, name string) ([]byte, string, error)
+	WriteIfVersion(ctx context.Context, name string, data []byte, version string) error
+}
+
+// Locker is implemented by backends which can lock a store, so only one process changes it at a time.
+// Lock takes the lock called `name`, returning a *LockedError if another process holds it. Unlock releases a lock this process holds.
+type Locker interface {
+	Lock(name string) error
+	Unlock(name string) error
+}
+
+// LockInfo describes the process which holds a lock
+type LockInfo struct {
+	Owner   string
+	PID     int
+	Host    string
+	Created time.Time
+}
+
+// LockedError is returned when a store is locked by another process
+type LockedError struct {
+	Holder LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("the store is locked by %s (pid %d on %s) since %s", e.Holder.Owner, e.Holder.PID, e.Holder.Host, e.Holder.Created.Format(time.RFC3339))
+}
+
+// LockStore locks the store with the lock named by Config.LockFile if the backend is a Locker, and returns a function which unlocks it.
+// The store should be locked before the index is loaded, and unlocked once it's been saved. Backends which can't be locked aren't,
+// but Save still refuses to overwrite an index another process has saved since it was loaded.
+func LockStore(backend interface{}, cfg *Config) (func() error, error) {
+	locker, ok := backend.(Locker)
+	if !ok {
+		return func() error { return nil }, nil
+	}
+	if err := locker.Lock(cfg.LockFile); err != nil {
+		return nil, err
+	}
+	return func() error { return locker.Unlock(cfg.LockFile) }, nil
+}
+
+// newLockInfo describes this process, for a lock it's taking
+func newLockInfo() LockInfo {
+	info := LockInfo{
+		Owner:   os.Getenv("USER"),
+		PID:     os.Getpid(),
+		Created: time.Now().UTC(),
+	}
+	if u, err := user.Current(); err == nil {
+		info.Owner = u.Username
+	}
+	info.Host, _ = os.Hostname()
+	return info
+}
+
+// heldByThisProcess returns true if the lock was taken by this process
+func (info LockInfo) heldByThisProcess() bool {
+	host, _ := os.Hostname()
+	return info.Host == host && info.PID == os.Getpid()
+}
+
+// stale returns true if the lock was taken by a process on this host which isn't running any more.
+// Whether a process on another host is still running can't be known, so its locks are never stale.
+func (info LockInfo) stale() bool {
+	host, err := os.Hostname()
+	return err == nil && info.Host == host && !processRunning(info.PID)
+}
+
+// indexCondition is what the saved index must still be for Save to replace it: the version it was at, or "" if it didn't exist
+type indexCondition struct {
+	version string
+}
+
+// checkGeneration returns ErrIndexChanged if the saved index isn't the generation this index was loaded or last saved as.
+// The index can only be checked if the writer can read it back (or is a ConditionalWriter).
+// This only stops Save overwriting changes saved by a process which didn't hold the store's lock (see LockStore), and another process
+// can still save the index between it being checked and written. A ConditionalWriter closes that gap: the condition returned
+// is what the saved index must still be when it's written, so writing it fails if it's changed since it was checked.
+func (ix *Index) checkGeneration(ctx context.Context, writer IndexWriter, crypter Crypter) (*indexCondition, error) {
+	if conditional, ok := writer.(ConditionalWriter); ok {
+		data, version, err := conditional.ReadVersion(ctx, ix.config.IndexFile)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			if ix.generation != 0 {
+				return nil, ErrIndexChanged
+			}
+			return &indexCondition{}, nil
+		}
+		if err := ix.checkSavedGeneration(data, crypter); err != nil || version == "" {
+			return nil, err
+		}
+		return &indexCondition{version}, nil
+	}
+
+	reader, ok := writer.(IndexReader)
+	if !ok {
+		return nil, nil
+	}
+	exists, err := FileExists(reader, ix.config.IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if ix.generation == 0 {
+			return nil, nil
+		}
+		return nil, ErrIndexChanged
+	}
+
+	data, err := readContext(ctx, reader, ix.config.IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	return nil, ix.checkSavedGeneration(data, crypter)
+}
+
+// checkSavedGeneration returns ErrIndexChanged if the saved (encrypted) index isn't the generation this index was loaded or last saved as
+func (ix *Index) checkSavedGeneration(data []byte, crypter Crypter) error {
+	decrypted, err := crypter.Decrypt(data)
+	if err != nil {
+		return err
+	}
+	var saved struct {
+		Generation int64
+	}
+	if err := json.Unmarshal(decrypted, &saved); err != nil {
+		return err
+	}
+	if saved.Generation != ix.generation {
+		return ErrIndexChanged
+	}
+	return nil
+}
+
+// writeIndex writes the saved index, only if it still meets the condition checkGeneration returned, if there is one
+func (ix *Index) writeIndex(ctx context.Context, writer IndexWriter, data []byte, condition *indexCondition) error {
+	if condition == nil {
+		return writeContext(ctx, writer, ix.config.IndexFile, data)
+	}
+	err := writer.(ConditionalWriter).WriteIfVersion(ctx, ix.config.IndexFile, data, condition.version)
+	if err == ErrWriteConflict {
+		return ErrIndexChanged
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package enstore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &LocalFileReadWriter{BasePath: dir}
+	cfg := NewDefaultConfig()
+
+	unlock, err := LockStore(store, cfg)
+	assert.Nil(t, err)
+	_, err = LockStore(store, cfg)
+	if locked, ok := err.(*LockedError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, os.Getpid(), locked.Holder.PID)
+	}
+	assert.Nil(t, unlock())
+	assert.False(t, store.Exists(cfg.LockFile))
+
+	// A lock left by a process on this host which has exited is replaced, but not one left by a process on another host
+	host, _ := os.Hostname()
+	writeLock := func(info LockInfo) {
+		data, err := json.Marshal(info)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, cfg.LockFile), data, 0644))
+	}
+	writeLock(LockInfo{Owner: "someone", PID: math.MaxInt32, Host: host, Created: time.Now()})
+	unlock, err = LockStore(store, cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, unlock())
+
+	// Only one of several processes finding the same stale lock takes it over
+	writeLock(LockInfo{Owner: "someone", PID: math.MaxInt32, Host: host, Created: time.Now()})
+	results := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			results <- (&LocalFileReadWriter{BasePath: dir}).Lock(cfg.LockFile)
+		}()
+	}
+	taken := 0
+	for i := 0; i < 8; i++ {
+		if err := <-results; err == nil {
+			taken++
+		} else {
+			assert.IsType(t, &LockedError{}, err)
+		}
+	}
+	assert.Equal(t, 1, taken)
+	// A live lock which replaced the stale one is put back
+	assert.IsType(t, &LockedError{}, store.removeStaleLock(cfg.LockFile))
+	assert.Nil(t, store.Unlock(cfg.LockFile))
+	names, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	writeLock(LockInfo{Owner: "someone", PID: math.MaxInt32, Host: host + ".elsewhere", Created: time.Now()})
+	_, err = LockStore(store, cfg)
+	assert.IsType(t, &LockedError{}, err)
+	assert.NotNil(t, store.Unlock(cfg.LockFile))
+	assert.True(t, store.Exists(cfg.LockFile))
+
+	// Backends which can't be locked aren't
+	unlock, err = LockStore(newTestStore(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, unlock())
+}
+
+func TestSaveIndexChanged(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	other := NewIndex(ix.config)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(100)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// Another index which was loaded before this one was saved can't overwrite it
+	assert.Nil(t, other.AddFile(newTestFile("b", testContents(100)), store, store, crypter))
+	assert.Equal(t, ErrIndexChanged, other.Save(store, crypter))
+	other, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Nil(t, other.AddFile(newTestFile("b", testContents(100)), store, store, crypter))
+	assert.Nil(t, other.Save(store, crypter))
+
+	assert.Nil(t, ix.RenameFile("a", "c"))
+	assert.Equal(t, ErrIndexChanged, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, fileNames(loaded))
+	assertFileContents(t, loaded, "a", testContents(100), store, crypter)
+}
+
+// racingWriter runs `race` once, just before a conditional write, as if another process saved the index in between
+type racingWriter struct {
+	*S3ReadWriter
+	race func()
+}
+
+func (w *racingWriter) WriteIfVersion(ctx context.Context, name string, data []byte, version string) error {
+	if race := w.race; race != nil {
+		w.race = nil
+		race()
+	}
+	return w.S3ReadWriter.WriteIfVersion(ctx, name, data, version)
+}
+
+func TestSaveIndexChangedWhileSaving(t *testing.T) {
+	_, server := newFakeS3()
+	defer server.Close()
+	s3 := newTestS3ReadWriter(t, server.URL)
+	ix, _, crypter := newTestIndex(t)
+	assert.Nil(t, ix.AddFile(newTestFile("a", testContents(100)), s3, s3, crypter))
+	assert.Nil(t, ix.Save(s3, crypter))
+	other, err := LoadIndex(s3, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Nil(t, other.AddFile(newTestFile("b", testContents(100)), s3, s3, crypter))
+
+	// The other index is saved after this one has checked the saved index, but before it's written
+	racing := &racingWriter{s3, func() {
+		assert.Nil(t, other.Save(s3, crypter))
+	}}
+	assert.Nil(t, ix.RenameFile("a", "c"))
+	assert.Equal(t, ErrIndexChanged, ix.Save(racing, crypter))
+	loaded, err := LoadIndex(s3, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, fileNames(loaded))
+	assertFileContents(t, loaded, "b", testContents(100), s3, crypter)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package enstore
+
+import "syscall"
+
+// processRunning returns true if a process with the PID is running on this host
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,16 @@
+package enstore
+
+import "os"
+
+// processRunning returns true if a process with the PID is running on this host
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IfSentient/enstore"
+)
+
+// newFileWrapper returns a file found with os.Lstat to be added to the store, with its attributes.
+// Symbolic links aren't followed; they're added with no contents, and the link target in their attributes.
+func newFileWrapper(path string, info os.FileInfo) (*fileWrapper, error) {
+	uid, gid := fileOwner(info)
+	attributes := &enstore.FileAttributes{
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		UID:     uid,
+		GID:     gid,
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		attributes.Symlink = target
+		return &fileWrapper{path: path, attributes: attributes}, nil
+	}
+	return &fileWrapper{path: path, size: info.Size(), attributes: attributes}, nil
+}
+
+// writeFile writes a file in the index to `name` under the directory `root`, creating its directory if needed,
+// and restores the file's attributes if it has any. Ownership is only restored when running as root.
+// Nothing is written through a symbolic link under root, so links extracted earlier can't point files outside it;
+// a link where the file is to be written is replaced.
+func writeFile(store *storeContext, file enstore.FileMetadata, root, name string) error {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := checkParents(root, name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	attributes := file.Attributes
+	if err == nil && (isSymlink(file) || info.Mode()&os.ModeSymlink != 0) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if isSymlink(file) {
+		if err := os.Symlink(attributes.Symlink, path); err != nil {
+			return err
+		}
+		return restoreOwner(path, attributes)
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = store.index.GetFile(file.Filename, out, store.backend, store.crypter)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || attributes == nil {
+		return err
+	}
+
+	if err := restoreOwner(path, attributes); err != nil {
+		return err
+	}
+	// Chmod after chown, as changing the owner clears the setuid and setgid bits
+	if err := os.Chmod(path, attributes.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, attributes.ModTime, attributes.ModTime)
+}
+
+// isSymlink returns true if a file in the index is a symbolic link
+func isSymlink(file enstore.FileMetadata) bool {
+	return file.Attributes != nil && file.Attributes.Symlink != ""
+}
+
+// checkParents returns an error if any of the directories `name` is in under `root` is a symbolic link
+func checkParents(root, name string) error {
+	dir := root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", dir)
+		}
+	}
+	return nil
+}
+
+// restoreOwner sets the owner of a file (or link) to the one in its attributes, if running as root
+func restoreOwner(path string, attributes *enstore.FileAttributes) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, attributes.UID, attributes.GID)
+}
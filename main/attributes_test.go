@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IfSentient/enstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileReplacesSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	victim := filepath.Join(dir, "victim")
+	assert.Nil(t, ioutil.WriteFile(victim, []byte("victim"), 0644))
+	src := filepath.Join(dir, "a")
+	assert.Nil(t, ioutil.WriteFile(src, []byte("contents"), 0600))
+
+	crypter, err := enstore.NewAEADCrypter(make([]byte, 32), enstore.AlgorithmAESGCM, false)
+	assert.Nil(t, err)
+	store := &storeContext{enstore.NewIndex(enstore.NewDefaultConfig()), enstore.NewMemoryReadWriter(), crypter}
+	info, err := os.Lstat(src)
+	assert.Nil(t, err)
+	file, err := newFileWrapper(src, info)
+	assert.Nil(t, err)
+	assert.Nil(t, store.index.AddFile(file, store.backend, store.backend, crypter))
+	fileMeta := store.index.ListFiles()[0]
+
+	// A link left by an earlier extract, where the file is now a regular file, is replaced rather than written through
+	out := filepath.Join(dir, "out")
+	assert.Nil(t, os.Mkdir(out, 0755))
+	if err := os.Symlink(victim, filepath.Join(out, "a")); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+	assert.Nil(t, writeFile(store, fileMeta, out, "a"))
+
+	data, err := ioutil.ReadFile(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, "victim", string(data))
+	info, err = os.Lstat(filepath.Join(out, "a"))
+	if assert.Nil(t, err) {
+		assert.True(t, info.Mode().IsRegular())
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	data, err = ioutil.ReadFile(filepath.Join(out, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "contents", string(data))
+	info, err = os.Stat(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IfSentient/enstore"
+)
+
+// storeContext is everything a command needs to work with the store
+type storeContext struct {
+	index   *enstore.Index
+	backend enstore.Backend
+	crypter enstore.Crypter
+}
+
+// command runs a subcommand with the arguments following its name
+type command func(store *storeContext, args []string) error
+
+var commands = map[string]command{
+	"add":      addCommand,
+	"compact":  compactCommand,
+	"extract":  extractCommand,
+	"gc":       gcCommand,
+	"ls":       lsCommand,
+	"mv":       mvCommand,
+	"snapshot": snapshotCommand,
+	"verify":   verifyCommand,
+}
+
+// runCommand runs the named subcommand
+func runCommand(name string, args []string, store *storeContext) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	return cmd(store, args)
+}
+
+// changesStore returns true if the named subcommand may change the store, so the store must be locked while it runs
+func changesStore(name string, args []string) bool {
+	switch name {
+	case "extract", "ls", "verify":
+		return false
+	case "snapshot":
+		return len(args) == 0 || args[0] != "list"
+	}
+	return true
+}
+
+// parseFlags parses a command's flags, which may come before, after or between its arguments, and returns the arguments
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	positional := make([]string, 0)
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// addCommand adds files, and every file and symbolic link in any directory trees, to the store with their attributes, and saves the index.
+// The files are added in one batch, so each block is written once. With -overwrite, files already in the store are replaced one at a time.
+func addCommand(store *storeContext, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	overwrite := flags.Bool("overwrite", false, "replace files which are already in the store")
+	args = parseFlags(flags, args)
+	if len(args) == 0 {
+		return errors.New("usage: add [-overwrite] <file or directory>...")
+	}
+
+	files := make([]*fileWrapper, 0)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, root := range args {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !(info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0) {
+				return err
+			}
+			file, err := newFileWrapper(path, info)
+			if err == nil {
+				files = append(files, file)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, file := range store.index.ListFiles() {
+		existing[file.Filename] = true
+	}
+	batch := make([]enstore.File, 0, len(files))
+	for _, file := range files {
+		name, err := enstore.CleanPath(file.Name())
+		if err == nil && existing[name] && !*overwrite {
+			err = enstore.ErrFileExists
+		}
+		if err != nil {
+			return fmt.Errorf("adding %s: %v", file.Name(), err)
+		}
+		if !existing[name] {
+			batch = append(batch, file)
+		} else if err := store.index.ReplaceFile(file, store.backend, store.backend, store.crypter); err != nil {
+			return fmt.Errorf("replacing %s: %v", file.Name(), err)
+		}
+	}
+	if err := store.index.AddFiles(batch, store.backend, store.backend, store.crypter); err != nil {
+		return err
+	}
+
+	if err := store.index.Save(store.backend, store.crypter); err != nil {
+		return err
+	}
+	fmt.Printf("Added %d files\n", len(files))
+	return nil
+}
+
+// extractCommand writes the files under a path in the index (or every file) to a directory, recreating their directory tree and attributes
+func extractCommand(store *storeContext, args []string) error {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	output := flags.String("o", ".", "directory to extract files into")
+	args = parseFlags(flags, args)
+	if len(args) > 1 {
+		return errors.New("usage: extract [path] [-o dir]")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix, _ = enstore.CleanPath(args[0])
+	}
+
+	// Symbolic links are created after everything else, so no file is written through one
+	files := store.index.ListFiles()
+	sort.SliceStable(files, func(i, j int) bool {
+		return !isSymlink(files[i]) && isSymlink(files[j])
+	})
+	extracted := 0
+	for _, file := range files {
+		name, err := enstore.CleanPath(file.Filename)
+		if err != nil || (prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"/")) {
+			continue
+		}
+		if err := writeFile(store, file, *output, name); err != nil {
+			return fmt.Errorf("extracting %s: %v", file.Filename, err)
+		}
+		extracted++
+	}
+	if extracted == 0 && prefix != "" {
+		return errors.New("no files in the index under " + prefix)
+	}
+	fmt.Printf("Extracted %d files\n", extracted)
+	return nil
+}
+
+// mvCommand renames a file or directory in the index, and saves the index
+func mvCommand(store *storeContext, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: mv <path> <new path>")
+	}
+	if err := store.index.RenameFile(args[0], args[1]); err != nil {
+		return err
+	}
+	return store.index.Save(store.backend, store.crypter)
+}
+
+// lsCommand lists the files and directories in a directory of the index
+func lsCommand(store *storeContext, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ls [directory]")
+	}
+	dir := ""
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	entries, err := store.index.ListDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir {
+			fmt.Printf("\t%s/\n", entry.Name)
+		} else {
+			fmt.Printf("\t%s\t%d\n", entry.Name, entry.Size)
+		}
+	}
+	return nil
+}
+
+// gcCommand finds and deletes blocks in the store which the index doesn't reference
+func gcCommand(store *storeContext, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report orphaned blocks, don't delete them")
+	flags.Parse(args)
+
+	lister, ok := store.backend.(enstore.BlockLister)
+	if !ok {
+		return errors.New("the store can't list its blocks")
+	}
+	deleter, _ := store.backend.(enstore.BlockDeleter)
+
+	orphans, err := store.index.GC(lister, deleter, *dryRun)
+	for _, name := range orphans {
+		fmt.Println("\t" + name)
+	}
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("Found %d orphaned blocks (dry run, nothing deleted)\n", len(orphans))
+	} else {
+		fmt.Printf("Deleted %d orphaned blocks\n", len(orphans))
+	}
+	return nil
+}
+
+// compactCommand rewrites fragmented files into contiguous blocks, and saves the index
+func compactCommand(store *storeContext, args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	maxBlocks := flags.Int("max-blocks", 0, "the most new blocks to write in this run, or 0 for no limit")
+	flags.Parse(args)
+
+	result, err := store.index.Compact(store.backend, store.backend, store.crypter, *maxBlocks)
+	if err != nil {
+		return err
+	}
+	if result.FilesRewritten > 0 {
+		if err := store.index.Save(store.backend, store.crypter); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Rewrote %d files onto %d new blocks, freed %d blocks\n", result.FilesRewritten, result.BlocksWritten, result.BlocksFreed)
+	return nil
+}
+
+// snapshotCommand creates, lists, restores and deletes snapshots of the index
+func snapshotCommand(store *storeContext, args []string) error {
+	usage := errors.New("usage: snapshot create|restore|delete <name>, or snapshot list")
+	if len(args) == 0 {
+		return usage
+	}
+	if args[0] == "list" {
+		for _, snapshot := range store.index.ListSnapshots() {
+			fmt.Printf("\t%s\t%s\n", snapshot.Name, snapshot.Created.Local().Format(time.RFC3339))
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return usage
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "create":
+		return store.index.Snapshot(name, store.backend, store.crypter)
+	case "restore":
+		if err := store.index.RestoreSnapshot(name, store.backend, store.crypter); err != nil {
+			return err
+		}
+	case "delete":
+		if err := store.index.DeleteSnapshot(name); err != nil {
+			return err
+		}
+	default:
+		return usage
+	}
+	return store.index.Save(store.backend, store.crypter)
+}
+
+// verifyCommand reads files from the store and reports any which are missing, corrupted or don't match their checksum
+func verifyCommand(store *storeContext, args []string) error {
+	results, err := store.index.Verify(args, store.backend, store.crypter)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status != enstore.VerifyOK {
+			failed++
+			fmt.Printf("\t%s\t%s: %v\n", result.Status, result.Filename, result.Err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(results))
+	}
+	fmt.Printf("Verified %d files\n", len(results))
+	return nil
+}
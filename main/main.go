@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/json"
 	"flag"
@@ -9,19 +8,53 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/IfSentient/enstore"
 )
 
+// fileWrapper is a file on disk to be added to the store. It isn't opened until it's read, and is closed as soon as all of it has been read,
+// so any number of files can be added at once.
 type fileWrapper struct {
-	file io.Reader
-	size int64
-	name string
+	path       string
+	size       int64
+	attributes *enstore.FileAttributes
+	file       *os.File
+	read       int64
+	done       bool
 }
 
 func (f *fileWrapper) Read(b []byte) (int, error) {
-	return f.file.Read(b)
+	if f.done || f.size == 0 {
+		return 0, io.EOF
+	}
+	if f.file == nil {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+	}
+
+	n, err := f.file.Read(b)
+	f.read += int64(n)
+	if err != nil || f.read >= f.size {
+		f.done = true
+		f.Close()
+	}
+	return n, err
+}
+
+// Close closes the file, if it's open
+func (f *fileWrapper) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
 }
 
 func (f *fileWrapper) Size() int64 {
@@ -29,26 +62,32 @@ func (f *fileWrapper) Size() int64 {
 }
 
 func (f *fileWrapper) Name() string {
-	return f.name
+	return f.path
+}
+
+func (f *fileWrapper) Attributes() *enstore.FileAttributes {
+	return f.attributes
 }
 
 func main() {
 	keyArg := flag.String("key", "", "key")
 	keyFileArg := flag.String("keyfile", "", "key file")
 	addFileArg := flag.String("add-file", "", "file to add")
+	overwriteArg := flag.Bool("overwrite", false, "replace the file if it's already in the store")
 	getFileArg := flag.String("get-file", "", "filename to retrieve")
 	delFileArg := flag.String("delete-file", "", "filemame to delete")
 	configFileArg := flag.String("config", "", "config file path")
 	outputArg := flag.String("o", "", "output file")
+	storeArg := flag.String("store", "", "store directory or URL ("+strings.Join(enstore.Backends(), ", ")+")")
+	snapshotArg := flag.String("snapshot", "", "snapshot to list or retrieve files from, instead of the current index")
 
 	flag.Parse()
 
-	var cfg *enstore.Config
-	var keyFile string
-	var storeDir string
+	cfg := enstore.NewDefaultConfig()
+	ccfg := &cliConfig{}
 	if *configFileArg != "" {
 		var err error
-		cfg, keyFile, storeDir, err = loadConfig(*configFileArg)
+		cfg, ccfg, err = loadConfig(*configFileArg)
 		if err != nil {
 			panic(err)
 		}
@@ -56,13 +95,14 @@ func main() {
 		// Look in default config file location, "config.json"
 		if _, err := os.Stat(enstore.ConfigfilePath); !os.IsNotExist(err) {
 			var err error
-			cfg, keyFile, storeDir, err = loadConfig(enstore.ConfigfilePath)
+			cfg, ccfg, err = loadConfig(enstore.ConfigfilePath)
 			if err != nil {
 				panic(err)
 			}
 		}
 	}
 
+	keyFile := ccfg.KeyFile
 	if *keyFileArg != "" {
 		keyFile = *keyFileArg
 	}
@@ -80,44 +120,72 @@ func main() {
 		panic("either -key or -keyfile is required or KeyFile must be specified in the config")
 	}
 
-	hasher := md5.New()
-	hasher.Write([]byte(initialKey))
-	key := hasher.Sum(nil)
+	// File I/O
+	if *storeArg != "" {
+		ccfg.StoreDir = *storeArg
+		ccfg.SFTP = nil
+	}
+	blockInterfacer, err := newStore(ccfg)
+	if err != nil {
+		panic(err)
+	}
 
-	// Make the AES crypter from the key
-	crypter, err := enstore.NewAESCrypter(key)
+	// Anything which changes the store locks it before loading the index, so other processes can't change it at the same time.
+	// Loading the index doesn't change the store, so commands which only read it don't need the lock,
+	// unless the store is new and the header newCrypter creates would be written.
+	headerExists, err := enstore.FileExists(blockInterfacer, cfg.HeaderFile)
 	if err != nil {
 		panic(err)
 	}
+	changes := *snapshotArg == "" && (*addFileArg != "" || *delFileArg != "" || (flag.NArg() > 0 && changesStore(flag.Arg(0), flag.Args()[1:])))
+	if changes || !headerExists {
+		unlock, err := enstore.LockStore(blockInterfacer, cfg)
+		if err != nil {
+			panic(err)
+		}
+		defer unlock()
+	}
 
-	// File I/O
-	blockInterfacer := enstore.LocalFileReadWriter{
-		BasePath: storeDir,
+	crypter, err := newCrypter(initialKey, blockInterfacer, cfg)
+	if err != nil {
+		panic(err)
 	}
 
 	// Index
-	index, err := enstore.LoadIndex(&blockInterfacer, crypter, cfg)
+	index, err := enstore.LoadIndexAt(blockInterfacer, crypter, cfg, *snapshotArg)
 	if err != nil {
 		panic(err)
 	}
 
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Arg(0), flag.Args()[1:], &storeContext{index, blockInterfacer, crypter})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	if *addFileArg != "" {
-		finfo, err := os.Stat(*addFileArg)
+		finfo, err := os.Lstat(*addFileArg)
 		if err != nil {
 			panic(err)
 		}
-		file, err := os.OpenFile(*addFileArg, os.O_RDONLY, 0644)
+		file, err := newFileWrapper(*addFileArg, finfo)
 		if err != nil {
 			panic(err)
 		}
 		defer file.Close()
 
-		err = index.AddFile(&fileWrapper{file, finfo.Size(), *addFileArg}, &blockInterfacer, &blockInterfacer, crypter)
+		if *overwriteArg {
+			err = index.ReplaceFile(file, blockInterfacer, blockInterfacer, crypter)
+		} else {
+			err = index.AddFile(file, blockInterfacer, blockInterfacer, crypter)
+		}
 		if err != nil {
 			panic(err)
 		}
 
-		err = index.Save(&blockInterfacer, crypter)
+		err = index.Save(blockInterfacer, crypter)
 		if err != nil {
 			panic(err)
 		}
@@ -127,19 +195,17 @@ func main() {
 	if *getFileArg != "" {
 		var writer io.Writer
 		if *outputArg != "" {
-			file, err := os.OpenFile(*outputArg, os.O_WRONLY|os.O_CREATE, 0644)
+			file, err := os.OpenFile(*outputArg, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 			if err != nil {
 				panic(err)
 			}
 			defer file.Close()
 			writer = file
 		} else {
-			buffer := &bytes.Buffer{}
-			defer fmt.Println(buffer.Bytes())
-			writer = buffer
+			writer = os.Stdout
 		}
 
-		err := index.GetFile(*getFileArg, writer, &blockInterfacer, crypter)
+		err := index.GetFile(*getFileArg, writer, blockInterfacer, crypter)
 		if err != nil {
 			panic(err)
 		}
@@ -147,11 +213,11 @@ func main() {
 	}
 
 	if *delFileArg != "" {
-		err := index.DeleteFile(*delFileArg, &blockInterfacer, &blockInterfacer, crypter, true)
+		err := index.DeleteFile(*delFileArg, blockInterfacer, blockInterfacer, crypter, true)
 		if err != nil {
 			panic(err)
 		}
-		err = index.Save(&blockInterfacer, crypter)
+		err = index.Save(blockInterfacer, crypter)
 		if err != nil {
 			panic(err)
 		}
@@ -169,27 +235,101 @@ func main() {
 
 }
 
+// newCrypter derives the store's crypter from the passphrase, creating the store header if the store is new.
+// Stores created before store headers existed (an index but no header) use the legacy unsalted MD5 key.
+func newCrypter(passphrase []byte, store enstore.Backend, cfg *enstore.Config) (enstore.Crypter, error) {
+	indexExists, err := enstore.FileExists(store, cfg.IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	headerExists, err := enstore.FileExists(store, cfg.HeaderFile)
+	if err != nil {
+		return nil, err
+	}
+	if indexExists && !headerExists {
+		hasher := md5.New()
+		hasher.Write(passphrase)
+		return enstore.NewAEADCrypter(hasher.Sum(nil), enstore.AlgorithmAESGCM, true)
+	}
+
+	header, err := enstore.LoadStoreHeader(store, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !headerExists {
+		if err := header.Save(store, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return enstore.NewCrypterFromPassphrase(passphrase, header)
+}
+
+// newStore returns the store backend described by the config: a remote host if SFTP is configured,
+// otherwise StoreDir, which may be a local directory or any URL with a registered backend
+func newStore(ccfg *cliConfig) (enstore.Backend, error) {
+	if ccfg.SFTP == nil {
+		return enstore.OpenBackend(ccfg.StoreDir)
+	}
+
+	sftpCfg := enstore.SFTPConfig{
+		Address:        ccfg.SFTP.Address,
+		User:           ccfg.SFTP.User,
+		Password:       ccfg.SFTP.Password,
+		KnownHostsFile: ccfg.SFTP.KnownHostsFile,
+		BasePath:       ccfg.SFTP.BasePath,
+	}
+	if sftpCfg.KnownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		sftpCfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if ccfg.SFTP.PrivateKeyFile != "" {
+		key, err := ioutil.ReadFile(ccfg.SFTP.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sftpCfg.PrivateKey = key
+	}
+	return enstore.NewSFTPReadWriter(sftpCfg)
+}
+
 type cliConfig struct {
-	KeyFile  string
+	KeyFile string
+	// StoreDir is a local directory, or a URL such as s3://bucket/prefix or sftp://user@host/path
 	StoreDir string
+	// SFTP, if set, stores blocks and the index on a remote host instead of in StoreDir.
+	// It allows for options which can't be put in an sftp:// URL, such as the private key file.
+	SFTP *sftpConfig
+}
+
+type sftpConfig struct {
+	Address        string
+	User           string
+	Password       string
+	PrivateKeyFile string
+	// KnownHostsFile is used to verify the host key, defaults to ~/.ssh/known_hosts
+	KnownHostsFile string
+	BasePath       string
 }
 
 // LoadConfig attempts to load a JSON file at a path into a new default Config
-func loadConfig(path string) (*enstore.Config, string, string, error) {
+func loadConfig(path string) (*enstore.Config, *cliConfig, error) {
 	cfg := enstore.NewDefaultConfig()
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 	err = json.Unmarshal(bytes, cfg)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 	ccfg := &cliConfig{}
 	err = json.Unmarshal(bytes, ccfg)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 
-	return cfg, ccfg.KeyFile, ccfg.StoreDir, nil
+	return cfg, ccfg, nil
 }
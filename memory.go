@@ -0,0 +1,79 @@
+package enstore
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MemoryReadWriter keeps blocks and the index in memory. It is safe for concurrent use.
+type MemoryReadWriter struct {
+	lock  sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemoryReadWriter creates a new, empty MemoryReadWriter
+func NewMemoryReadWriter() *MemoryReadWriter {
+	return &MemoryReadWriter{files: make(map[string][]byte)}
+}
+
+func (m *MemoryReadWriter) Read(name string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+// ReadRange reads `length` bytes of a file starting at `offset`. If the file ends first, the bytes read and io.EOF are returned.
+func (m *MemoryReadWriter) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	if offset >= int64(len(data)) {
+		return []byte{}, io.EOF
+	}
+	end := offset + int64(length)
+	if end > int64(len(data)) {
+		return append([]byte{}, data[offset:]...), io.EOF
+	}
+	return append([]byte{}, data[offset:end]...), nil
+}
+
+func (m *MemoryReadWriter) Write(name string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *MemoryReadWriter) Exists(name string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, ok := m.files[name]
+	return ok
+}
+
+func (m *MemoryReadWriter) Delete(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemoryReadWriter) List() ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,102 @@
+package enstore
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool runs tasks, such as encrypting and writing blocks, on up to `size` goroutines at once.
+// Once a task fails, the pool's context is cancelled so tasks still running can stop early, no more tasks are started,
+// and the first error is returned by submit and wait. A pool of size 1 or less runs each task as it's submitted.
+type workerPool struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	errLock sync.Mutex
+	err     error
+}
+
+func newWorkerPool(ctx context.Context, size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &workerPool{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// submit runs a task once a worker is free, blocking until then.
+// If a task has already failed or the pool's context is done, the task isn't run and the error is returned instead.
+func (p *workerPool) submit(task func(ctx context.Context) error) error {
+	if cap(p.slots) == 1 {
+		if p.ctx.Err() != nil {
+			return p.failure()
+		}
+		if err := task(p.ctx); err != nil {
+			p.fail(err)
+			return err
+		}
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.failure()
+	}
+	// A slot may have come free after the pool was stopped
+	if p.ctx.Err() != nil {
+		<-p.slots
+		return p.failure()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		if err := task(p.ctx); err != nil {
+			p.fail(err)
+		}
+	}()
+	return nil
+}
+
+// wait waits for all the submitted tasks to finish, and returns the first error any of them returned
+func (p *workerPool) wait() error {
+	p.wg.Wait()
+	err := p.failure()
+	p.cancel()
+	return err
+}
+
+// fail records the first error, and cancels the rest of the tasks
+func (p *workerPool) fail(err error) {
+	p.errLock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.errLock.Unlock()
+	p.cancel()
+}
+
+// failure returns the error which stopped the pool: the first task's error, or the context's if it was cancelled from outside
+func (p *workerPool) failure() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+// writeTask returns a task which encrypts and writes a block
+func writeTask(block *Block, crypter Crypter, writer BlockWriter) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return writeBlock(ctx, block, crypter, writer)
+	}
+}
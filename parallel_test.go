@@ -0,0 +1,128 @@
+package enstore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowStore is a testStore which takes a while to read and write, and records how many reads and writes were in progress at once
+type slowStore struct {
+	*testStore
+	delay      time.Duration
+	active     int32
+	maxActive  int32
+	failWrites int32
+}
+
+func (s *slowStore) track() func() {
+	active := atomic.AddInt32(&s.active, 1)
+	for {
+		max := atomic.LoadInt32(&s.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&s.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	return func() { atomic.AddInt32(&s.active, -1) }
+}
+
+func (s *slowStore) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	defer s.track()()
+	return s.testStore.ReadRange(name, offset, length)
+}
+
+func (s *slowStore) Write(name string, data []byte) error {
+	defer s.track()()
+	if isBlockName(name) && atomic.AddInt32(&s.failWrites, -1) == 0 {
+		return errors.New("write failed")
+	}
+	return s.testStore.Write(name, data)
+}
+
+func TestWorkerPool(t *testing.T) {
+	var active, maxActive, ran int32
+	pool := newWorkerPool(context.Background(), 3)
+	for i := 0; i < 12; i++ {
+		assert.Nil(t, pool.submit(func(ctx context.Context) error {
+			n := atomic.AddInt32(&active, 1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}))
+	}
+	assert.Nil(t, pool.wait())
+	assert.Equal(t, int32(12), ran)
+	assert.Equal(t, int32(3), maxActive)
+
+	// Once a task fails, the rest are cancelled and no more are started
+	failure := errors.New("task failed")
+	pool = newWorkerPool(context.Background(), 2)
+	cancelled := make(chan bool, 1)
+	assert.Nil(t, pool.submit(func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- true
+		return ctx.Err()
+	}))
+	assert.Nil(t, pool.submit(func(ctx context.Context) error {
+		return failure
+	}))
+	assert.True(t, <-cancelled)
+	assert.Equal(t, failure, pool.submit(func(ctx context.Context) error {
+		t.Error("task submitted after a failure was run")
+		return nil
+	}))
+	assert.Equal(t, failure, pool.wait())
+}
+
+func TestConcurrentGetFile(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Concurrency = 4
+	contents := randomContents(40000, 1)
+	assert.Nil(t, ix.AddFile(newTestFile("a", contents), store, store, crypter))
+	assert.True(t, len(ix.fileMap["a"].Blocks) >= 8)
+
+	// The sections are read ahead of the reader, but come out in order
+	slow := &slowStore{testStore: store, delay: 5 * time.Millisecond}
+	assertFileContents(t, ix, "a", contents, slow, crypter)
+	assert.Equal(t, int32(4), slow.maxActive)
+
+	slow.maxActive = 0
+	ix.config.Concurrency = 1
+	assertFileContents(t, ix, "a", contents, slow, crypter)
+	assert.Equal(t, int32(1), slow.maxActive)
+}
+
+func TestConcurrentAddFiles(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	ix.config.Concurrency = 4
+	files := make([]File, 0)
+	for i := 0; i < 10; i++ {
+		files = append(files, newTestFile(string(rune('a'+i)), randomContents(4096, int64(i))))
+	}
+
+	slow := &slowStore{testStore: store, delay: 5 * time.Millisecond}
+	assert.Nil(t, ix.AddFiles(files, slow, slow, crypter))
+	assert.True(t, slow.maxActive > 1)
+	for i := 0; i < 10; i++ {
+		assertFileContents(t, ix, string(rune('a'+i)), randomContents(4096, int64(i)), store, crypter)
+	}
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// A failed write is returned once the other writes have finished
+	slow.failWrites = 3
+	more := []File{newTestFile("k", randomContents(20000, 10))}
+	assert.Equal(t, errors.New("write failed"), ix.AddFiles(more, slow, slow, crypter))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&slow.active))
+}
@@ -0,0 +1,110 @@
+package enstore
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrInvalidPath is returned for a file path which doesn't name anything, such as "" or "/"
+	ErrInvalidPath = errors.New("invalid file path")
+	// ErrDirNotFound is returned when listing a directory no file in the index is in
+	ErrDirNotFound = errors.New("directory does not exist in the index")
+	// ErrFileExists is returned when a file would replace a file or directory which is already in the index
+	ErrFileExists = errors.New("a file or directory with that name already exists in the index")
+)
+
+// DirEntry is a file or directory in a directory of the index
+type DirEntry struct {
+	// Name is the entry's name within the directory, and Path its full path in the index
+	Name  string
+	Path  string
+	IsDir bool
+	// Size is the size of the file, or 0 for a directory
+	Size int64
+}
+
+// CleanPath normalizes a file path into the form names are stored in the index: '/'-separated, with no empty, "." or ".." elements,
+// and no leading or trailing '/'. Like tar, leading ".." elements are dropped, so a path can never refer outside the tree it's extracted to.
+// On Windows, '\' separators are converted to '/'.
+func CleanPath(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if cleaned == "" {
+		return "", ErrInvalidPath
+	}
+	return cleaned, nil
+}
+
+// cleanDirPath normalizes a directory path like CleanPath, but returns "" for the root of the index
+func cleanDirPath(dir string) string {
+	cleaned, err := CleanPath(dir)
+	if err != nil {
+		return ""
+	}
+	return cleaned
+}
+
+// lookupFile finds a file in the index by name. Files added before names were normalized are stored under the name they were added with,
+// so that's tried first, and then the normalized name.
+func (ix *Index) lookupFile(filename string) (*FileMetadata, bool) {
+	if fileMeta, ok := ix.fileMap[filename]; ok {
+		return fileMeta, true
+	}
+	cleaned, err := CleanPath(filename)
+	if err != nil {
+		return nil, false
+	}
+	fileMeta, ok := ix.fileMap[cleaned]
+	return fileMeta, ok
+}
+
+// ListDir returns the files and directories directly inside the directory `dir`, sorted by name. "" or "/" lists the top of the index.
+// Directories only exist as the paths of the files in them, so an empty directory can't be stored; ErrDirNotFound is returned if nothing is in `dir`.
+func (ix *Index) ListDir(dir string) ([]DirEntry, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	dir = cleanDirPath(dir)
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	entries := make([]DirEntry, 0)
+	dirs := make(map[string]bool)
+	for _, file := range ix.files {
+		name, err := CleanPath(file.Filename)
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rel := name[len(prefix):]
+		if i := strings.Index(rel, "/"); i >= 0 {
+			if !dirs[rel[:i]] {
+				dirs[rel[:i]] = true
+				entries = append(entries, DirEntry{Name: rel[:i], Path: prefix + rel[:i], IsDir: true})
+			}
+			continue
+		}
+		entries = append(entries, DirEntry{Name: rel, Path: file.Filename, Size: file.Size})
+	}
+	if len(entries) == 0 && dir != "" {
+		return nil, ErrDirNotFound
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// renamedFile is a File stored under a different name
+type renamedFile struct {
+	File
+	name string
+}
+
+func (f *renamedFile) Name() string {
+	return f.name
+}
@@ -0,0 +1,80 @@
+package enstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		err      error
+	}{
+		{"file", "file", nil},
+		{"dir/file", "dir/file", nil},
+		{"./dir//file/", "dir/file", nil},
+		{"/abs/dir/file", "abs/dir/file", nil},
+		{"dir/../other/./file", "other/file", nil},
+		{"../../file", "file", nil},
+		{"", "", ErrInvalidPath},
+		{"/", "", ErrInvalidPath},
+		{"..", "", ErrInvalidPath},
+	}
+	for _, test := range tests {
+		cleaned, err := CleanPath(test.name)
+		assert.Equal(t, test.err, err, test.name)
+		assert.Equal(t, test.expected, cleaned, test.name)
+	}
+}
+
+func TestAddFileCleansPath(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	contents := testContents(1000)
+	assert.Nil(t, ix.AddFile(newTestFile("./dir//file", contents), store, store, crypter))
+
+	files := ix.ListFiles()
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "dir/file", files[0].Filename)
+	assertFileContents(t, ix, "dir/file", contents, store, crypter)
+	assertFileContents(t, ix, "/dir/file", contents, store, crypter)
+
+	assert.Equal(t, ErrInvalidPath, ix.AddFile(newTestFile("/", contents), store, store, crypter))
+	assert.Nil(t, ix.DeleteFile("./dir/file", store, store, crypter, false))
+	assert.Equal(t, 0, len(ix.ListFiles()))
+}
+
+func TestListDir(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for _, name := range []string{"b", "a/x", "a/y/z", "a/y/w", "c/d"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, testContents(100)), store, store, crypter))
+	}
+
+	entries, err := ix.ListDir("")
+	assert.Nil(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "a", Path: "a", IsDir: true},
+		{Name: "b", Path: "b", Size: 100},
+		{Name: "c", Path: "c", IsDir: true},
+	}, entries)
+
+	entries, err = ix.ListDir("/a/")
+	assert.Nil(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "x", Path: "a/x", Size: 100},
+		{Name: "y", Path: "a/y", IsDir: true},
+	}, entries)
+
+	entries, err = ix.ListDir("a/y")
+	assert.Nil(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "w", Path: "a/y/w", Size: 100},
+		{Name: "z", Path: "a/y/z", Size: 100},
+	}, entries)
+
+	_, err = ix.ListDir("missing")
+	assert.Equal(t, ErrDirNotFound, err)
+	_, err = ix.ListDir("b")
+	assert.Equal(t, ErrDirNotFound, err)
+}
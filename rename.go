@@ -0,0 +1,111 @@
+package enstore
+
+import (
+	"errors"
+	"strings"
+)
+
+// RenameFile moves a file, or every file in a directory, to a new path. Only the index changes, so no blocks are read or written,
+// and the move takes effect when the index is saved. ErrFileExists is returned if anything is already at the new path
+// (or a file is at one of its parent directories), in which case nothing is moved.
+func (ix *Index) RenameFile(oldName, newName string) error {
+	return ix.update(func(work *Index) error {
+		return work.renameFile(oldName, newName)
+	})
+}
+
+func (ix *Index) renameFile(oldName, newName string) error {
+	newName, err := CleanPath(newName)
+	if err != nil {
+		return err
+	}
+
+	// renames maps the names of the files being moved to their new names
+	renames := make(map[string]string)
+	if fileMeta, ok := ix.lookupFile(oldName); ok {
+		renames[fileMeta.Filename] = newName
+	} else {
+		dir := cleanDirPath(oldName)
+		if dir == "" {
+			return ErrInvalidPath
+		}
+		if newName == dir || strings.HasPrefix(newName, dir+"/") {
+			return errors.New("can't move a directory into itself")
+		}
+		for _, file := range ix.files {
+			if name, err := CleanPath(file.Filename); err == nil && strings.HasPrefix(name, dir+"/") {
+				renames[file.Filename] = newName + name[len(dir):]
+			}
+		}
+	}
+	if len(renames) == 0 {
+		return errors.New("file does not exist in the index")
+	}
+	if err := ix.checkRenames(newName, renames); err != nil {
+		return err
+	}
+
+	for i := range ix.files {
+		if name, ok := renames[ix.files[i].Filename]; ok {
+			ix.files[i].Filename = name
+		}
+	}
+	ix.reindexFiles()
+	return nil
+}
+
+// checkRenames returns ErrFileExists if the path being moved to, or any of the new names, would clash with the files which aren't being moved,
+// or if the new names clash with each other
+func (ix *Index) checkRenames(newName string, renames map[string]string) error {
+	moving := make(map[string]bool, len(renames))
+	names := make([]string, 0, len(renames))
+	for oldName, name := range renames {
+		moving[oldName] = true
+		names = append(names, name)
+	}
+	files, dirs := ix.indexPaths(moving)
+	if files[newName] || dirs[newName] {
+		return ErrFileExists
+	}
+	return checkNewNames(names, files, dirs)
+}
+
+// indexPaths returns the cleaned names of the files in the index, other than those in `excluded`, and of the directories they're in
+func (ix *Index) indexPaths(excluded map[string]bool) (map[string]bool, map[string]bool) {
+	files := make(map[string]bool, len(ix.files))
+	dirs := make(map[string]bool)
+	for _, file := range ix.files {
+		if excluded[file.Filename] {
+			continue
+		}
+		name, err := CleanPath(file.Filename)
+		if err != nil {
+			continue
+		}
+		files[name] = true
+		for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+			dirs[name[:i]] = true
+		}
+	}
+	return files, dirs
+}
+
+// checkNewNames returns ErrFileExists if any of the (cleaned) names would clash with the `files` and `dirs` already in the index, or with each other.
+// A name clashes with a file or directory of the same name, and with a file at any of its parent directories.
+func checkNewNames(names []string, files, dirs map[string]bool) error {
+	targets := make(map[string]bool, len(names))
+	targetDirs := make(map[string]bool)
+	for _, name := range names {
+		if files[name] || dirs[name] || targets[name] || targetDirs[name] {
+			return ErrFileExists
+		}
+		targets[name] = true
+		for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+			if files[name[:i]] || targets[name[:i]] {
+				return ErrFileExists
+			}
+			targetDirs[name[:i]] = true
+		}
+	}
+	return nil
+}
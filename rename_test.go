@@ -0,0 +1,63 @@
+package enstore
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fileNames(ix *Index) []string {
+	names := make([]string, 0)
+	for _, file := range ix.ListFiles() {
+		names = append(names, file.Filename)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRenameFile(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for i, name := range []string{"a/x", "a/y/z", "b", "c/d"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, testContents(100*(i+1))), store, store, crypter))
+	}
+	assert.Nil(t, ix.Save(store, crypter))
+	before := storeContents(store)
+
+	assert.Nil(t, ix.RenameFile("b", "e/b"))
+	assert.Nil(t, ix.RenameFile("/a/", "f/a"))
+	assert.Equal(t, []string{"c/d", "e/b", "f/a/x", "f/a/y/z"}, fileNames(ix))
+	assertFileContents(t, ix, "e/b", testContents(300), store, crypter)
+	assertFileContents(t, ix, "f/a/y/z", testContents(200), store, crypter)
+
+	// No blocks were written
+	assert.Nil(t, ix.Save(store, crypter))
+	after := storeContents(store)
+	delete(before, ix.config.IndexFile)
+	delete(after, ix.config.IndexFile)
+	assert.Equal(t, before, after)
+
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, fileNames(ix), fileNames(loaded))
+}
+
+func TestRenameFileConflicts(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for _, name := range []string{"a/x", "a/y", "b", "c/d"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, testContents(100)), store, store, crypter))
+	}
+
+	assert.Equal(t, ErrFileExists, ix.RenameFile("b", "a/x"))
+	assert.Equal(t, ErrFileExists, ix.RenameFile("b", "c"))
+	assert.Equal(t, ErrFileExists, ix.RenameFile("a/x", "b/x"))
+	assert.Equal(t, ErrFileExists, ix.RenameFile("a", "c"))
+	assert.Equal(t, ErrInvalidPath, ix.RenameFile("b", "/"))
+	assert.NotNil(t, ix.RenameFile("a", "a/z"))
+	assert.NotNil(t, ix.RenameFile("missing", "e"))
+	assert.Equal(t, []string{"a/x", "a/y", "b", "c/d"}, fileNames(ix))
+
+	// Files can move within a directory they're being moved out of
+	assert.Nil(t, ix.RenameFile("a/x", "a/x/x"))
+	assert.Equal(t, []string{"a/x/x", "a/y", "b", "c/d"}, fileNames(ix))
+}
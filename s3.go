@@ -0,0 +1,516 @@
+package enstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultS3PartSize is the default size of each part of a multipart upload (16 MiB).
+	// Ciphertext of the default block size fits in a single PUT.
+	DefaultS3PartSize int = 16777216
+	// MinS3PartSize is the smallest part S3 accepts in a multipart upload, other than the last (5 MiB)
+	MinS3PartSize int = 5242880
+	// DefaultS3Region is the region used for request signing if none is configured
+	DefaultS3Region string = "us-east-1"
+
+	s3Service       = "s3"
+	s3DateFormat    = "20060102"
+	s3TimeFormat    = "20060102T150405Z"
+	s3SigningMethod = "AWS4-HMAC-SHA256"
+)
+
+// S3Config configures an S3ReadWriter
+type S3Config struct {
+	// Endpoint is the scheme and host of the S3-compatible service, such as "https://s3.us-west-2.amazonaws.com" or "http://localhost:9000".
+	// Objects are addressed path-style, as {Endpoint}/{Bucket}/{Prefix}{name}
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the name of every object. If it doesn't end in "/", one is added
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PartSize is the size of each part of a multipart upload. Anything larger than this is uploaded in parts.
+	// It must be at least MinS3PartSize.
+	PartSize int
+	// HTTPClient is used to make requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// S3ReadWriter reads and writes blocks and the index as objects in an S3-compatible bucket
+type S3ReadWriter struct {
+	config S3Config
+	now    func() time.Time
+}
+
+// S3Error is returned when the S3 service responds with an error
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// NewS3ReadWriter creates a new S3ReadWriter, filling in defaults for any optional config values
+func NewS3ReadWriter(cfg S3Config) (*S3ReadWriter, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("s3: endpoint is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, err
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = DefaultS3PartSize
+	}
+	if cfg.PartSize < MinS3PartSize {
+		return nil, fmt.Errorf("s3: part size must be at least %d bytes", MinS3PartSize)
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &S3ReadWriter{config: cfg, now: time.Now}, nil
+}
+
+func (s *S3ReadWriter) Read(name string) ([]byte, error) {
+	return s.ReadContext(context.Background(), name)
+}
+
+// ReadContext downloads an object, cancelling the request if the context is done
+func (s *S3ReadWriter) ReadContext(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ReadRange reads `length` bytes of an object starting at `offset`. If the object ends first, the bytes read and io.EOF are returned.
+func (s *S3ReadWriter) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	return s.ReadRangeContext(context.Background(), name, offset, length)
+}
+
+// ReadRangeContext is ReadRange, cancelling the request if the context is done
+func (s *S3ReadWriter) ReadRangeContext(ctx context.Context, name string, offset int64, length int) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	headers := http.Header{}
+	headers.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	resp, err := s.do(ctx, http.MethodGet, name, nil, headers, nil)
+	if err != nil {
+		if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return []byte{}, io.EOF
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// A server which ignores the Range header returns the whole object
+	if resp.StatusCode == http.StatusOK {
+		if offset >= int64(len(data)) {
+			return []byte{}, io.EOF
+		}
+		data = data[offset:]
+		if len(data) > length {
+			data = data[:length]
+		}
+	}
+	if len(data) < length {
+		return data, io.EOF
+	}
+	return data, nil
+}
+
+// Write uploads an object, using a multipart upload if it is larger than the configured PartSize
+func (s *S3ReadWriter) Write(name string, data []byte) error {
+	return s.WriteContext(context.Background(), name, data)
+}
+
+// WriteContext is Write, cancelling the upload if the context is done
+func (s *S3ReadWriter) WriteContext(ctx context.Context, name string, data []byte) error {
+	return s.write(ctx, name, data, nil)
+}
+
+// ReadVersion downloads an object along with its ETag, or returns nil data if it doesn't exist
+func (s *S3ReadWriter) ReadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == http.StatusNotFound {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// WriteIfVersion uploads an object only if its ETag is still `version` (with If-Match), or if `version` is "" only if it doesn't exist
+// (with If-None-Match), returning ErrWriteConflict otherwise
+func (s *S3ReadWriter) WriteIfVersion(ctx context.Context, name string, data []byte, version string) error {
+	headers := http.Header{}
+	if version == "" {
+		headers.Set("If-None-Match", "*")
+	} else {
+		headers.Set("If-Match", version)
+	}
+	err := s.write(ctx, name, data, headers)
+	// A conditional write racing another write to the same object can also fail with Conflict
+	if s3Err, ok := err.(*S3Error); ok && (s3Err.StatusCode == http.StatusPreconditionFailed || s3Err.StatusCode == http.StatusConflict) {
+		return ErrWriteConflict
+	}
+	return err
+}
+
+// write uploads an object, with the headers on the request which creates it
+func (s *S3ReadWriter) write(ctx context.Context, name string, data []byte, headers http.Header) error {
+	if len(data) > s.config.PartSize {
+		return s.writeMultipart(ctx, name, data, headers)
+	}
+	resp, err := s.do(ctx, http.MethodPut, name, nil, headers, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Exists returns false if the object doesn't exist. If checking fails for any other reason, it's assumed to exist,
+// so reading it reports the error; use CheckExists to get the error instead.
+func (s *S3ReadWriter) Exists(name string) bool {
+	exists, err := s.CheckExists(name)
+	return exists || err != nil
+}
+
+// CheckExists returns true if the object exists, false if the service responds that it doesn't, or any other error checking for it
+func (s *S3ReadWriter) CheckExists(name string) (bool, error) {
+	resp, err := s.do(context.Background(), http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Delete removes an object. Deleting an object which doesn't exist is not an error.
+func (s *S3ReadWriter) Delete(name string) error {
+	resp, err := s.do(context.Background(), http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List returns the names of all objects directly under the prefix
+func (s *S3ReadWriter) List() ([]string, error) {
+	names := make([]string, 0)
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.config.Prefix},
+		"delimiter": {"/"},
+	}
+	for {
+		resp, err := s.doKey(context.Background(), http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// writeMultipart uploads an object in PartSize parts, with the headers on the request which completes the upload.
+// If any part fails, or the context is done, the upload is aborted.
+func (s *S3ReadWriter) writeMultipart(ctx context.Context, name string, data []byte, headers http.Header) error {
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	complete := s3CompleteMultipartUpload{}
+	for offset, partNumber := 0, 1; offset < len(data); offset, partNumber = offset+s.config.PartSize, partNumber+1 {
+		end := offset + s.config.PartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {initiated.UploadID},
+		}
+		resp, err := s.do(ctx, http.MethodPut, name, query, nil, data[offset:end])
+		if err != nil {
+			s.abortMultipart(name, initiated.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{partNumber, resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s.abortMultipart(name, initiated.UploadID)
+		return err
+	}
+	resp, err = s.do(ctx, http.MethodPost, name, url.Values{"uploadId": {initiated.UploadID}}, headers, body)
+	if err != nil {
+		s.abortMultipart(name, initiated.UploadID)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Completing an upload can fail after a 200 response has started, in which case the body is an error
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var errResp s3ErrorResponse
+	if xml.Unmarshal(result, &errResp) == nil {
+		return &S3Error{resp.StatusCode, errResp.Code, errResp.Message}
+	}
+	return nil
+}
+
+// abortMultipart aborts an upload. It isn't cancelled with the upload's context, so the parts are cleaned up after a cancelled upload.
+func (s *S3ReadWriter) abortMultipart(name, uploadID string) {
+	resp, err := s.do(context.Background(), http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do makes a signed request for an object, returning an *S3Error for any non-2xx response
+func (s *S3ReadWriter) do(ctx context.Context, method, name string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	return s.doKey(ctx, method, s.config.Prefix+name, query, headers, body)
+}
+
+// doKey makes a signed request for an object key (or for the bucket, if the key is empty)
+func (s *S3ReadWriter) doKey(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	rawURL := fmt.Sprintf("%s/%s", s.config.Endpoint, s3EscapePath(s.config.Bucket))
+	if key != "" {
+		rawURL += "/" + s3EscapePath(key)
+	}
+	if len(query) > 0 {
+		rawURL += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.sign(req, body)
+
+	resp, err := s.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		var errResp s3ErrorResponse
+		if data, err := ioutil.ReadAll(resp.Body); err == nil && xml.Unmarshal(data, &errResp) == nil {
+			s3Err.Code = errResp.Code
+			s3Err.Message = errResp.Message
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request. The host, range and x-amz-* headers are signed.
+func (s *S3ReadWriter) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", now.Format(s3TimeFormat))
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if s.config.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.config.SessionToken)
+	}
+
+	// Canonical headers are lowercase, sorted, and always include the host
+	signed := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, signed[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(s3DateFormat), s.config.Region, s3Service)
+	stringToSign := strings.Join([]string{
+		s3SigningMethod,
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.config.SecretKey), now.Format(s3DateFormat))
+	key = s3HMAC(key, s.config.Region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningMethod, s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape URI-encodes everything except unreserved characters, as required for signing
+func s3Escape(s string) string {
+	escaped := &strings.Builder{}
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3EscapePath URI-encodes each segment of a path
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes a query string sorted by key, as required for signing
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,325 @@
+package enstore
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSFTPTimeout is the default timeout for establishing an SSH connection
+const DefaultSFTPTimeout = 30 * time.Second
+
+// SFTPConfig configures an SFTPReadWriter
+type SFTPConfig struct {
+	// Address is the host:port of the SSH server
+	Address string
+	User    string
+	// Password and/or PrivateKey (PEM-encoded) are used to authenticate
+	Password   string
+	PrivateKey []byte
+	// The host key is verified against KnownHostsFile (in OpenSSH known_hosts format), or by HostKeyCallback if set.
+	// One of the two is required.
+	KnownHostsFile  string
+	HostKeyCallback ssh.HostKeyCallback
+	// BasePath is the remote directory blocks and the index are stored in
+	BasePath string
+	Timeout  time.Duration
+}
+
+// SFTPReadWriter reads and writes blocks and the index as files on a remote host over SFTP.
+// A single SSH connection is opened when first needed and reused, and is re-established if it is lost.
+type SFTPReadWriter struct {
+	config    SFTPConfig
+	sshConfig *ssh.ClientConfig
+	lock      sync.Mutex
+	conn      *ssh.Client
+	client    *sftp.Client
+}
+
+// NewSFTPReadWriter creates a new SFTPReadWriter. No connection is made until the first operation.
+func NewSFTPReadWriter(cfg SFTPConfig) (*SFTPReadWriter, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("sftp: address is required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultSFTPTimeout
+	}
+
+	hostKeyCallback := cfg.HostKeyCallback
+	if hostKeyCallback == nil {
+		if cfg.KnownHostsFile == "" {
+			return nil, errors.New("sftp: a known hosts file or host key callback is required to verify the host key")
+		}
+		var err error
+		hostKeyCallback, err = knownhosts.New(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth := make([]ssh.AuthMethod, 0)
+	if len(cfg.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp: a password or private key is required")
+	}
+
+	return &SFTPReadWriter{
+		config: cfg,
+		sshConfig: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         cfg.Timeout,
+		},
+	}, nil
+}
+
+func (s *SFTPReadWriter) Read(name string) ([]byte, error) {
+	var data []byte
+	err := s.withClient(func(client *sftp.Client) error {
+		file, err := client.Open(s.path(name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+		return err
+	})
+	return data, err
+}
+
+// ReadRange reads `length` bytes of a file starting at `offset`. If the file ends first, the bytes read and io.EOF are returned.
+func (s *SFTPReadWriter) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	var data []byte
+	err := s.withClient(func(client *sftp.Client) error {
+		file, err := client.Open(s.path(name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		buf := make([]byte, length)
+		n, err := file.ReadAt(buf, offset)
+		if err == io.EOF && n == length {
+			err = nil
+		}
+		data = buf[:n]
+		return err
+	})
+	return data, err
+}
+
+// Write replaces a file by writing a temporary file in the same directory and renaming it over the original,
+// which is atomic if the server supports POSIX renames. Otherwise the original is moved aside first, and put back if the rename fails,
+// so a lost connection never leaves a truncated file in its place.
+func (s *SFTPReadWriter) Write(name string, data []byte) error {
+	return s.withClient(func(client *sftp.Client) error {
+		target := s.path(name)
+		temp := s.tempPath(target, "tmp")
+		file, err := client.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			client.Remove(temp)
+			return err
+		}
+		if err := file.Close(); err != nil {
+			client.Remove(temp)
+			return err
+		}
+
+		if err := client.PosixRename(temp, target); err != nil {
+			if _, ok := err.(*sftp.StatusError); !ok {
+				return err
+			}
+			// Plain SFTP renames won't replace an existing file
+			old := s.tempPath(target, "old")
+			moved := true
+			if err := client.Rename(target, old); err != nil {
+				if !os.IsNotExist(err) {
+					client.Remove(temp)
+					return err
+				}
+				moved = false
+			}
+			if err := client.Rename(temp, target); err != nil {
+				if moved {
+					client.Rename(old, target)
+				}
+				client.Remove(temp)
+				return err
+			}
+			if moved {
+				client.Remove(old)
+			}
+		}
+		return nil
+	})
+}
+
+// tempPath returns a unique name in the same directory as `target` for a temporary copy of it, hidden from List by a leading "."
+func (s *SFTPReadWriter) tempPath(target, kind string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return path.Join(path.Dir(target), fmt.Sprintf(".%s.%s.%x", path.Base(target), kind, suffix))
+}
+
+// Exists returns false if the file doesn't exist. If checking fails for any other reason, it's assumed to exist,
+// so reading it reports the error; use CheckExists to get the error instead.
+func (s *SFTPReadWriter) Exists(name string) bool {
+	exists, err := s.CheckExists(name)
+	return exists || err != nil
+}
+
+// CheckExists returns true if the file exists, false if the server reports that it doesn't, or any other error checking for it
+func (s *SFTPReadWriter) CheckExists(name string) (bool, error) {
+	err := s.withClient(func(client *sftp.Client) error {
+		_, err := client.Stat(s.path(name))
+		return err
+	})
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes a file. Deleting a file which doesn't exist is not an error.
+func (s *SFTPReadWriter) Delete(name string) error {
+	return s.withClient(func(client *sftp.Client) error {
+		err := client.Remove(s.path(name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// List returns the names of all files in BasePath
+func (s *SFTPReadWriter) List() ([]string, error) {
+	var names []string
+	err := s.withClient(func(client *sftp.Client) error {
+		dir := s.config.BasePath
+		if dir == "" {
+			dir = "."
+		}
+		infos, err := client.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		names = make([]string, 0, len(infos))
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				names = append(names, info.Name())
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Close closes the SSH connection, if one is open
+func (s *SFTPReadWriter) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.disconnect()
+}
+
+// withClient runs `op` with a connected client. If the connection has been lost, it reconnects and retries once.
+func (s *SFTPReadWriter) withClient(op func(*sftp.Client) error) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = op(client)
+	if !isConnectionLost(err) {
+		return err
+	}
+
+	s.lock.Lock()
+	if s.client == client {
+		s.disconnect()
+	}
+	s.lock.Unlock()
+	client, err = s.connect()
+	if err != nil {
+		return err
+	}
+	return op(client)
+}
+
+// connect returns the current client, dialing a new connection if there isn't one
+func (s *SFTPReadWriter) connect() (*sftp.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", s.config.Address, s.sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	s.client = client
+	return client, nil
+}
+
+// disconnect closes the current connection. The lock must be held.
+func (s *SFTPReadWriter) disconnect() error {
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.conn.Close()
+	s.client = nil
+	s.conn = nil
+	return err
+}
+
+func (s *SFTPReadWriter) path(name string) string {
+	if s.config.BasePath == "" {
+		return name
+	}
+	return path.Join(s.config.BasePath, name)
+}
+
+// isConnectionLost returns true if an error means the SSH connection is no longer usable
+func isConnectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == sftp.ErrSSHFxConnectionLost || err == sftp.ErrSSHFxNoConnection {
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,228 @@
+package enstore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server which serves the sftp subsystem from a directory
+type testSFTPServer struct {
+	listener    net.Listener
+	hostKey     ssh.PublicKey
+	dir         string
+	lock        sync.Mutex
+	connections []ssh.Conn
+}
+
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	dir, err := ioutil.TempDir("", "enstore-sftp")
+	assert.Nil(t, err)
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "enstore" && string(password) == "hunter2" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	server := &testSFTPServer{listener: listener, hostKey: signer.PublicKey(), dir: dir}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *testSFTPServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.connections = append(s.connections, sshConn)
+	s.lock.Unlock()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(channelRequests)
+		go func() {
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.dir))
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// dropConnections closes every connection, as if the network went away
+func (s *testSFTPServer) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.connections {
+		conn.Close()
+	}
+}
+
+func (s *testSFTPServer) connectionCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.connections)
+}
+
+func (s *testSFTPServer) Close() {
+	s.listener.Close()
+	s.dropConnections()
+	os.RemoveAll(s.dir)
+}
+
+func TestSFTPReadWriter(t *testing.T) {
+	server := newTestSFTPServer(t)
+	defer server.Close()
+
+	s, err := NewSFTPReadWriter(SFTPConfig{
+		Address:         server.listener.Addr().String(),
+		User:            "enstore",
+		Password:        "hunter2",
+		HostKeyCallback: ssh.FixedHostKey(server.hostKey),
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.False(t, s.Exists("block"))
+	exists, err := s.CheckExists("block")
+	assert.False(t, exists)
+	assert.Nil(t, err)
+	contents := testContents(1000)
+	assert.Nil(t, s.Write("block", testContents(2000)))
+	assert.Nil(t, s.Write("block", contents))
+	assert.True(t, s.Exists("block"))
+	// Files are replaced by renaming a temporary file over them, which mustn't be left behind
+	names, err := ioutil.ReadDir(server.dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(names))
+
+	// Errors other than the file not existing are reported, not mistaken for it missing
+	exists, err = s.CheckExists("block/file")
+	assert.False(t, exists)
+	assert.NotNil(t, err)
+	assert.True(t, s.Exists("block/file"))
+	data, err := s.Read("block")
+	assert.Nil(t, err)
+	assert.Equal(t, contents, data)
+
+	data, err = s.ReadRange("block", 100, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, contents[100:150], data)
+	data, err = s.ReadRange("block", 990, 50)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, contents[990:], data)
+
+	// All of that was done over one connection
+	assert.Equal(t, 1, server.connectionCount())
+
+	// If the connection is lost, the next operation reconnects
+	server.dropConnections()
+	data, err = s.Read("block")
+	assert.Nil(t, err)
+	assert.Equal(t, contents, data)
+	assert.Equal(t, 2, server.connectionCount())
+}
+
+func TestSFTPReadWriterDeleteList(t *testing.T) {
+	server := newTestSFTPServer(t)
+	defer server.Close()
+	s, err := NewSFTPReadWriter(SFTPConfig{
+		Address:         server.listener.Addr().String(),
+		User:            "enstore",
+		Password:        "hunter2",
+		HostKeyCallback: ssh.FixedHostKey(server.hostKey),
+		BasePath:        server.dir,
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	testDeleteList(t, s)
+}
+
+func TestSFTPReadWriterHostKey(t *testing.T) {
+	server := newTestSFTPServer(t)
+	defer server.Close()
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	wrongKey, _ := ssh.NewPublicKey(otherKey)
+	s, err := NewSFTPReadWriter(SFTPConfig{
+		Address:         server.listener.Addr().String(),
+		User:            "enstore",
+		Password:        "hunter2",
+		HostKeyCallback: ssh.FixedHostKey(wrongKey),
+	})
+	assert.Nil(t, err)
+
+	_, err = s.Read("block")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, server.connectionCount())
+
+	// There is no insecure default
+	_, err = NewSFTPReadWriter(SFTPConfig{
+		Address:  server.listener.Addr().String(),
+		User:     "enstore",
+		Password: "hunter2",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestSFTPReadWriterKnownHosts(t *testing.T) {
+	server := newTestSFTPServer(t)
+	defer server.Close()
+
+	knownHosts, err := ioutil.TempFile("", "known_hosts")
+	assert.Nil(t, err)
+	defer os.Remove(knownHosts.Name())
+	address := server.listener.Addr().String()
+	knownHosts.WriteString(knownhosts.Line([]string{knownhosts.Normalize(address)}, server.hostKey) + "\n")
+	knownHosts.Close()
+
+	s, err := NewSFTPReadWriter(SFTPConfig{
+		Address:        address,
+		User:           "enstore",
+		Password:       "hunter2",
+		KnownHostsFile: knownHosts.Name(),
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Write("index", []byte("index")))
+}
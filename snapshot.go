@@ -0,0 +1,217 @@
+package enstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrSnapshotExists is returned when creating a snapshot with the name of an existing one
+	ErrSnapshotExists = errors.New("a snapshot with that name already exists")
+	// ErrSnapshotNotFound is returned when a snapshot doesn't exist in the index
+	ErrSnapshotNotFound = errors.New("snapshot does not exist in the index")
+	// ErrInvalidSnapshotName is returned when a snapshot name isn't made up of letters, digits, '.', '_' and '-'
+	ErrInvalidSnapshotName = errors.New("snapshot names may only contain letters, digits, '.', '_' and '-'")
+	// ErrReadOnlyIndex is returned when changing an index loaded from a snapshot
+	ErrReadOnlyIndex = errors.New("an index loaded from a snapshot can't be changed")
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// SnapshotMetadata describes a snapshot of the index
+type SnapshotMetadata struct {
+	Name    string
+	Created time.Time
+	// Blocks are the names of the block files the snapshot references, which are kept as long as the snapshot is
+	Blocks []string
+}
+
+// SnapshotFile returns the name of the file a snapshot of the index is saved in
+func SnapshotFile(cfg *Config, name string) string {
+	return cfg.IndexFile + ".snapshot." + name
+}
+
+// Snapshot saves a copy of the index as it is now under `name`, which can be loaded later with LoadIndexAt,
+// and then saves the index (committing any changes made since it was last saved).
+// As long as the snapshot exists, the blocks it references are never modified or deleted, so files can be read as they were.
+func (ix *Index) Snapshot(name string, writer IndexWriter, crypter Crypter) error {
+	return ix.SnapshotContext(context.Background(), name, writer, crypter)
+}
+
+// SnapshotContext is Snapshot, stopping if the context is cancelled
+func (ix *Index) SnapshotContext(ctx context.Context, name string, writer IndexWriter, crypter Crypter) error {
+	ix.writeLock.Lock()
+	defer ix.writeLock.Unlock()
+	if ix.readOnly {
+		return ErrReadOnlyIndex
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return ErrInvalidSnapshotName
+	}
+	if ix.findSnapshot(name) >= 0 {
+		return ErrSnapshotExists
+	}
+
+	snapshot := SnapshotMetadata{
+		Name:    name,
+		Created: time.Now().UTC(),
+		Blocks:  make([]string, 0, len(ix.blocks)),
+	}
+	for _, blockMeta := range ix.blocks {
+		snapshot.Blocks = append(snapshot.Blocks, blockMeta.Filename)
+	}
+	sort.Strings(snapshot.Blocks)
+
+	jsonBytes, err := json.Marshal(indexJson{
+		Files:      ix.files,
+		Blocks:     ix.blocks,
+		StartBlock: ix.startBlock,
+		Generation: ix.generation,
+		Chunks:     ix.chunks,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := crypter.Encrypt(jsonBytes)
+	if err != nil {
+		return err
+	}
+	if err := writeContext(ctx, writer, SnapshotFile(ix.config, name), data); err != nil {
+		return err
+	}
+
+	ix.lock.Lock()
+	ix.snapshots = append(ix.snapshots, snapshot)
+	ix.rebuildProtected()
+	ix.lock.Unlock()
+	return ix.save(ctx, writer, crypter)
+}
+
+// ListSnapshots returns all the snapshots of the index, oldest first
+func (ix *Index) ListSnapshots() []SnapshotMetadata {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	snapshots := make([]SnapshotMetadata, len(ix.snapshots))
+	copy(snapshots, ix.snapshots)
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots
+}
+
+// DeleteSnapshot removes a snapshot from the index. Its file, and any blocks only it referenced, are deleted when the index is next saved.
+func (ix *Index) DeleteSnapshot(name string) error {
+	return ix.update(func(work *Index) error {
+		return work.deleteSnapshot(name)
+	})
+}
+
+func (ix *Index) deleteSnapshot(name string) error {
+	idx := ix.findSnapshot(name)
+	if idx < 0 {
+		return ErrSnapshotNotFound
+	}
+
+	snapshot := ix.snapshots[idx]
+	ix.snapshots = append(ix.snapshots[:idx], ix.snapshots[idx+1:]...)
+	ix.rebuildProtected()
+
+	live := ix.referencedBlockFiles()
+	for _, filename := range snapshot.Blocks {
+		if !live[filename] {
+			ix.supersede(filename)
+		}
+	}
+	ix.supersede(SnapshotFile(ix.config, name))
+	return nil
+}
+
+// RestoreSnapshot replaces the files in the index with the files as they were when a snapshot was taken. The snapshots are kept.
+// Like other changes, this takes effect when the index is saved, and blocks only the replaced files used are deleted then.
+func (ix *Index) RestoreSnapshot(name string, reader BlockReader, crypter Crypter) error {
+	return ix.RestoreSnapshotContext(context.Background(), name, reader, crypter)
+}
+
+// RestoreSnapshotContext is RestoreSnapshot, stopping if the context is cancelled
+func (ix *Index) RestoreSnapshotContext(ctx context.Context, name string, reader BlockReader, crypter Crypter) error {
+	return ix.update(func(work *Index) error {
+		return work.restoreSnapshot(ctx, name, reader, crypter)
+	})
+}
+
+func (ix *Index) restoreSnapshot(ctx context.Context, name string, reader BlockReader, crypter Crypter) error {
+	if ix.findSnapshot(name) < 0 {
+		return ErrSnapshotNotFound
+	}
+	snapshot, err := readIndex(ctx, reader, SnapshotFile(ix.config, name), crypter, ix.config)
+	if err != nil {
+		return err
+	}
+
+	replaced := make([]string, 0, len(ix.blocks))
+	for _, blockMeta := range ix.blocks {
+		replaced = append(replaced, blockMeta.Filename)
+	}
+	ix.files = snapshot.files
+	ix.blocks = snapshot.blocks
+	ix.startBlock = snapshot.startBlock
+	ix.blockAllocation = snapshot.blockAllocation
+	ix.chunks = snapshot.chunks
+	ix.reindexFiles()
+
+	live := ix.referencedBlockFiles()
+	for _, filename := range replaced {
+		if !live[filename] {
+			ix.supersede(filename)
+		}
+	}
+	return nil
+}
+
+// LoadIndexAt loads a snapshot of the index. The returned index can be read from, but not changed.
+// If `snapshot` is empty, the current index is loaded as with LoadIndex.
+func LoadIndexAt(reader IndexReader, crypter Crypter, cfg *Config, snapshot string) (*Index, error) {
+	return LoadIndexAtContext(context.Background(), reader, crypter, cfg, snapshot)
+}
+
+// LoadIndexAtContext is LoadIndexAt, stopping if the context is cancelled
+func LoadIndexAtContext(ctx context.Context, reader IndexReader, crypter Crypter, cfg *Config, snapshot string) (*Index, error) {
+	current, err := LoadIndexContext(ctx, reader, crypter, cfg)
+	if err != nil || snapshot == "" {
+		return current, err
+	}
+	if current.findSnapshot(snapshot) < 0 {
+		return nil, ErrSnapshotNotFound
+	}
+
+	index, err := readIndex(ctx, reader, SnapshotFile(cfg, snapshot), crypter, cfg)
+	if err != nil {
+		return nil, err
+	}
+	index.readOnly = true
+	return index, nil
+}
+
+// findSnapshot returns the index of the named snapshot, or -1 if it doesn't exist
+func (ix *Index) findSnapshot(name string) int {
+	for i, snapshot := range ix.snapshots {
+		if snapshot.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// rebuildProtected rebuilds the set of block files referenced by snapshots
+func (ix *Index) rebuildProtected() {
+	ix.protected = make(map[string]bool)
+	for _, snapshot := range ix.snapshots {
+		for _, filename := range snapshot.Blocks {
+			ix.protected[filename] = true
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package enstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(6000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Snapshot("v1", store, crypter))
+	assert.False(t, store.Exists(ix.config.JournalFile))
+
+	// Changes after the snapshot leave the blocks it uses alone, even once they're saved
+	assert.Nil(t, ix.DeleteFile("a", store, store, crypter, true))
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	orphans, err := ix.GC(store, store, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orphans))
+
+	v1, err := LoadIndexAt(store, crypter, ix.config, "v1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(v1.ListFiles()))
+	assertFileContents(t, v1, "a", a, store, crypter)
+	assert.Equal(t, ErrReadOnlyIndex, v1.AddFile(newTestFile("c", a), store, store, crypter))
+	assert.Equal(t, ErrReadOnlyIndex, v1.Save(store, crypter))
+
+	current, err := LoadIndexAt(store, crypter, ix.config, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(current.ListFiles()))
+	assertFileContents(t, current, "b", b, store, crypter)
+	snapshots := current.ListSnapshots()
+	if assert.Equal(t, 1, len(snapshots)) {
+		assert.Equal(t, "v1", snapshots[0].Name)
+		assert.Equal(t, 1, len(snapshots[0].Blocks))
+	}
+
+	// Errors
+	_, err = LoadIndexAt(store, crypter, ix.config, "v2")
+	assert.Equal(t, ErrSnapshotNotFound, err)
+	assert.Equal(t, ErrSnapshotExists, ix.Snapshot("v1", store, crypter))
+	assert.Equal(t, ErrInvalidSnapshotName, ix.Snapshot("../v2", store, crypter))
+	assert.Equal(t, ErrSnapshotNotFound, ix.RestoreSnapshot("v2", store, crypter))
+	assert.Equal(t, ErrSnapshotNotFound, ix.DeleteSnapshot("v2"))
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a, b := testContents(1000), testContents(6000)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Snapshot("v1", store, crypter))
+	assert.Nil(t, ix.AddFile(newTestFile("b", b), store, store, crypter))
+	assert.Nil(t, ix.Snapshot("v2", store, crypter))
+	assert.Nil(t, ix.DeleteFile("a", store, store, crypter, false))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	assert.Nil(t, ix.RestoreSnapshot("v1", store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.Equal(t, 1, len(ix.ListFiles()))
+	assertFileContents(t, ix, "a", a, store, crypter)
+	assert.Equal(t, 2, len(ix.ListSnapshots()))
+
+	// Once no snapshot uses them, b's blocks are deleted along with the snapshot
+	assert.Nil(t, ix.DeleteSnapshot("v2"))
+	assert.Nil(t, ix.DeleteSnapshot("v1"))
+	assert.Nil(t, ix.Save(store, crypter))
+	assert.Equal(t, 0, len(ix.ListSnapshots()))
+	assert.Equal(t, []string{ix.blocks[ix.startBlock].Filename, ix.config.IndexFile}, storeNames(store))
+
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assertFileContents(t, loaded, "a", a, store, crypter)
+	assert.Equal(t, 0, len(loaded.protected))
+}
+
+func TestSnapshotSurvivesGCAndCompact(t *testing.T) {
+	ix, store, crypter, contents := newFragmentedIndex(t, 3000)
+	assert.Nil(t, ix.Snapshot("v1", store, crypter))
+
+	// Change the live index so the snapshot's blocks are no longer all referenced by it, then clean up after it
+	assert.Nil(t, ix.DeleteFile("small-1", store, store, crypter, true))
+	result, err := ix.Compact(store, store, crypter, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.FilesRewritten)
+	assert.Nil(t, ix.Save(store, crypter))
+	orphans, err := ix.GC(store, store, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orphans))
+
+	v1, err := LoadIndexAt(store, crypter, ix.config, "v1")
+	assert.Nil(t, err)
+	assert.Equal(t, len(contents), len(v1.ListFiles()))
+	for name, expected := range contents {
+		assertFileContents(t, v1, name, expected, store, crypter)
+	}
+	delete(contents, "small-1")
+	for name, expected := range contents {
+		assertFileContents(t, ix, name, expected, store, crypter)
+	}
+}
@@ -0,0 +1,70 @@
+package enstore
+
+// update makes a change to the index. Changes are made one at a time, each on a copy of the index, which replaces the index's state
+// once the change has succeeded, so until then readers see the index as it was. If the change fails, the index is left as it was,
+// and any block files it wrote are left in the store until GC removes them.
+func (ix *Index) update(change func(work *Index) error) error {
+	ix.writeLock.Lock()
+	defer ix.writeLock.Unlock()
+	if ix.readOnly {
+		return ErrReadOnlyIndex
+	}
+
+	work := ix.clone()
+	if err := change(work); err != nil {
+		return err
+	}
+
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	ix.files = work.files
+	ix.fileMap = work.fileMap
+	ix.blocks = work.blocks
+	ix.startBlock = work.startBlock
+	ix.blockAllocation = work.blockAllocation
+	ix.written = work.written
+	ix.superseded = work.superseded
+	ix.abandoned = work.abandoned
+	ix.snapshots = work.snapshots
+	ix.protected = work.protected
+	ix.chunks = work.chunks
+	ix.chunkKey = work.chunkKey
+	return nil
+}
+
+// clone returns a copy of the index's state which can be changed without affecting the index.
+// Anything the index's methods modify in place is copied; the protected set is only ever replaced, so it's shared.
+func (ix *Index) clone() *Index {
+	work := &Index{
+		files:           make([]FileMetadata, len(ix.files)),
+		blocks:          make(map[string]BlockMetadata, len(ix.blocks)),
+		startBlock:      ix.startBlock,
+		blockAllocation: make(map[string][]BlockLocation, len(ix.blockAllocation)),
+		config:          ix.config,
+		generation:      ix.generation,
+		written:         make(map[string]bool, len(ix.written)),
+		writing:         make(map[string]bool),
+		superseded:      append([]string{}, ix.superseded...),
+		abandoned:       ix.abandoned,
+		snapshots:       append([]SnapshotMetadata{}, ix.snapshots...),
+		protected:       ix.protected,
+		chunks:          make(map[string]*ChunkMetadata, len(ix.chunks)),
+		chunkKey:        ix.chunkKey,
+	}
+	copy(work.files, ix.files)
+	work.reindexFiles()
+	for name, blockMeta := range ix.blocks {
+		work.blocks[name] = blockMeta
+	}
+	for name, allocations := range ix.blockAllocation {
+		work.blockAllocation[name] = append([]BlockLocation{}, allocations...)
+	}
+	for filename := range ix.written {
+		work.written[filename] = true
+	}
+	for id, chunk := range ix.chunks {
+		chunkCopy := *chunk
+		work.chunks[id] = &chunkCopy
+	}
+	return work
+}
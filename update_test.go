@@ -0,0 +1,130 @@
+package enstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateIsolated(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	a := randomContents(1000, 1)
+	assert.Nil(t, ix.AddFile(newTestFile("a", a), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+
+	// While b is being written to the block a is on, a can still be read, and b isn't listed until it's been written
+	slow := &slowStore{testStore: store, delay: 200 * time.Millisecond}
+	done := make(chan error)
+	go func() {
+		done <- ix.AddFile(newTestFile("b", randomContents(1000, 2)), slow, slow, crypter)
+	}()
+	for atomic.LoadInt32(&slow.active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"a"}, fileNames(ix))
+	assertFileContents(t, ix, "a", a, store, crypter)
+	assert.Nil(t, <-done)
+	assert.Equal(t, []string{"a", "b"}, fileNames(ix))
+	assertFileContents(t, ix, "b", randomContents(1000, 2), store, crypter)
+
+	// A change which fails leaves the index as it was
+	blocks := fmt.Sprint(ix.blocks)
+	slow.delay = 0
+	slow.failWrites = 1
+	assert.NotNil(t, ix.AddFile(newTestFile("c", randomContents(1000, 3)), slow, slow, crypter))
+	assert.Equal(t, []string{"a", "b"}, fileNames(ix))
+	assert.Equal(t, blocks, fmt.Sprint(ix.blocks))
+	assert.Nil(t, ix.AddFile(newTestFile("c", randomContents(1000, 3)), store, store, crypter))
+	assert.Nil(t, ix.Save(store, crypter))
+	assertFileContents(t, ix, "a", a, store, crypter)
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, ix.AddFile(newTestFile(fmt.Sprintf("stable/%d", i), randomContents(3000, int64(i))), store, store, crypter))
+		assert.Nil(t, ix.AddFile(newTestFile(fmt.Sprintf("d/%d", i), testContents(500)), store, store, crypter))
+	}
+	assert.Nil(t, ix.Save(store, crypter))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	reader := func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			// The directory is always seen entirely at one path or the other, never part way through a move
+			moved := map[string]int{}
+			for _, file := range ix.ListFiles() {
+				moved[strings.Split(file.Filename, "/")[0]]++
+			}
+			assert.True(t, moved["d"]+moved["e"] == 5 && moved["d"]*moved["e"] == 0, fmt.Sprint(moved))
+
+			for i := 0; i < 5; i++ {
+				assertFileContents(t, ix, fmt.Sprintf("stable/%d", i), randomContents(3000, int64(i)), store, crypter)
+			}
+			_, err := ix.ListDir("stable")
+			assert.Nil(t, err)
+			results, err := ix.Verify(nil, store, crypter)
+			if assert.Nil(t, err) {
+				for _, result := range results {
+					assert.Equal(t, VerifyOK, result.Status, result.Filename)
+				}
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go reader()
+	}
+
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; i < 20; i++ {
+			assert.Nil(t, ix.RenameFile("d", "e"))
+			assert.Nil(t, ix.RenameFile("e", "d"))
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for i := 0; i < 20; i++ {
+			pair := []File{
+				newTestFile(fmt.Sprintf("w/%d/a", i), testContents(700)),
+				newTestFile(fmt.Sprintf("w/%d/b", i), testContents(900)),
+			}
+			assert.Nil(t, ix.AddFiles(pair, store, store, crypter))
+			if i%2 == 0 {
+				assert.Nil(t, ix.ReplaceFile(newTestFile(fmt.Sprintf("w/%d/a", i), testContents(800)), store, store, crypter))
+			} else {
+				assert.Nil(t, ix.RenameFile(fmt.Sprintf("w/%d", i), fmt.Sprintf("w/%d", i+100)))
+			}
+		}
+		for i := 0; i < 20; i += 4 {
+			assert.Nil(t, ix.DeleteFile(fmt.Sprintf("w/%d/a", i), store, store, crypter, true))
+			assert.Nil(t, ix.DeleteFile(fmt.Sprintf("w/%d/b", i), store, store, crypter, true))
+		}
+	}()
+	writers.Wait()
+	close(stop)
+	wg.Wait()
+
+	assert.Nil(t, ix.Save(store, crypter))
+	loaded, err := LoadIndex(store, crypter, ix.config)
+	assert.Nil(t, err)
+	assert.Equal(t, fileNames(ix), fileNames(loaded))
+	assert.Equal(t, 5+5+30, len(fileNames(loaded)))
+	assertFileContents(t, loaded, "w/2/a", testContents(800), store, crypter)
+	assertFileContents(t, loaded, "w/103/b", testContents(900), store, crypter)
+}
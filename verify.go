@@ -0,0 +1,188 @@
+package enstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// ErrChecksumMismatch is returned when a file read from the store doesn't match the size or SHA-256 recorded in the index
+var ErrChecksumMismatch = errors.New("file contents don't match the checksum in the index")
+
+// VerifyStatus is the outcome of verifying a file
+type VerifyStatus int
+
+const (
+	// VerifyOK means the file was read, and matched its checksum
+	VerifyOK VerifyStatus = iota
+	// VerifyMissing means blocks the file is stored on don't exist
+	VerifyMissing
+	// VerifyCorrupted means the file's blocks couldn't be read or decrypted (or decompressed)
+	VerifyCorrupted
+	// VerifyMismatched means the file was read, but didn't match its size or checksum
+	VerifyMismatched
+)
+
+func (s VerifyStatus) String() string {
+	switch s {
+	case VerifyOK:
+		return "ok"
+	case VerifyMissing:
+		return "missing"
+	case VerifyCorrupted:
+		return "corrupted"
+	case VerifyMismatched:
+		return "mismatched"
+	}
+	return "unknown"
+}
+
+// VerifyResult is the result of verifying a file
+type VerifyResult struct {
+	Filename string
+	Status   VerifyStatus
+	// Err is the error reading the file, if it wasn't OK
+	Err error
+}
+
+// Verify reads each of the named files (or every file, if none are named) from the store, checking that all their blocks exist,
+// decrypt, and that the contents match what was added. A result is returned for each file, sorted by name.
+// Files added before checksums were recorded are only checked against their size.
+// If checking whether a block exists fails, the results so far are returned with the error, rather than the file reported missing or corrupted.
+func (ix *Index) Verify(filenames []string, reader IndexReader, crypter Crypter) ([]VerifyResult, error) {
+	return ix.VerifyContext(context.Background(), filenames, reader, crypter)
+}
+
+// VerifyContext is Verify, stopping if the context is cancelled. The results for the files verified before then are returned with the context's error.
+func (ix *Index) VerifyContext(ctx context.Context, filenames []string, reader IndexReader, crypter Crypter) ([]VerifyResult, error) {
+	// The files are verified as they were when Verify was called, without holding up changes to the index
+	ix.lock.RLock()
+	filenames = append([]string{}, filenames...)
+	if len(filenames) == 0 {
+		for _, file := range ix.files {
+			filenames = append(filenames, file.Filename)
+		}
+	}
+	files := make(map[string]FileMetadata, len(filenames))
+	locations := make(map[string][]BlockLocation, len(filenames))
+	for i, filename := range filenames {
+		fileMeta, ok := ix.lookupFile(filename)
+		if !ok {
+			ix.lock.RUnlock()
+			return nil, errors.New("file does not exist in the index: " + filename)
+		}
+		filenames[i] = fileMeta.Filename
+		files[fileMeta.Filename] = *fileMeta
+		locations[fileMeta.Filename] = ix.blockFileLocations(fileMeta.Blocks)
+	}
+	ix.lock.RUnlock()
+	sort.Strings(filenames)
+
+	// Each block is only checked once, however many files are on it
+	exists := make(map[string]bool)
+	results := make([]VerifyResult, 0, len(filenames))
+	for _, filename := range filenames {
+		fileMeta := files[filename]
+		result, err := ix.verifyFile(ctx, &fileMeta, locations[filename], exists, reader, crypter)
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// verifyFile verifies a file, recording which blocks exist in `exists`. An error is only returned if checking whether a block exists fails.
+func (ix *Index) verifyFile(ctx context.Context, fileMeta *FileMetadata, locations []BlockLocation, exists map[string]bool, reader IndexReader, crypter Crypter) (VerifyResult, error) {
+	filename := fileMeta.Filename
+	for _, loc := range locations {
+		blockExists, checked := exists[loc.Block]
+		if !checked {
+			var err error
+			if blockExists, err = FileExists(reader, loc.Block); err != nil {
+				return VerifyResult{}, err
+			}
+			exists[loc.Block] = blockExists
+		}
+		if !blockExists {
+			return VerifyResult{filename, VerifyMissing, errors.New("block " + loc.Block + " does not exist")}, nil
+		}
+	}
+
+	file, err := ix.openFile(ctx, fileMeta, locations, reader, crypter)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, file)
+		file.Close()
+	}
+	switch {
+	case err == nil:
+		return VerifyResult{filename, VerifyOK, nil}, nil
+	case err == ErrChecksumMismatch:
+		return VerifyResult{filename, VerifyMismatched, err}, nil
+	default:
+		return VerifyResult{filename, VerifyCorrupted, err}, nil
+	}
+}
+
+// hashingFile is a File which hashes its contents as they're read
+type hashingFile struct {
+	File
+	hash hash.Hash
+}
+
+func newHashingFile(file File) *hashingFile {
+	return &hashingFile{file, sha256.New()}
+}
+
+func (f *hashingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.hash.Write(p[:n])
+	return n, err
+}
+
+// sum returns the hex-encoded hash of everything read so far
+func (f *hashingFile) sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// verifyingReader checks a file's contents against its size and checksum once it's been read to the end,
+// returning ErrChecksumMismatch instead of io.EOF if they don't match
+type verifyingReader struct {
+	io.ReadCloser
+	size     int64
+	checksum string
+	read     int64
+	hash     hash.Hash
+}
+
+func newVerifyingReader(file io.ReadCloser, fileMeta *FileMetadata) *verifyingReader {
+	return &verifyingReader{
+		ReadCloser: file,
+		size:       fileMeta.Size,
+		checksum:   fileMeta.SHA256,
+		hash:       sha256.New(),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.read += int64(n)
+	v.hash.Write(p[:n])
+	if v.read > v.size {
+		return n, ErrChecksumMismatch
+	}
+	if err == io.EOF {
+		if v.read != v.size || (v.checksum != "" && hex.EncodeToString(v.hash.Sum(nil)) != v.checksum) {
+			return n, ErrChecksumMismatch
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+package enstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	for _, mode := range []string{"plain", "compressed", "dedup"} {
+		t.Run(mode, func(t *testing.T) {
+			ix, store, crypter := newDedupTestIndex(t)
+			ix.config.Dedup = mode == "dedup"
+			if mode == "compressed" {
+				ix.config.Compression = CompressionGzip
+			}
+			contents := testContents(10000)
+			sum := sha256.Sum256(contents)
+			assert.Nil(t, ix.AddFile(newTestFile("a", contents), store, store, crypter))
+			assert.Equal(t, hex.EncodeToString(sum[:]), ix.fileMap["a"].SHA256)
+			assertFileContents(t, ix, "a", contents, store, crypter)
+
+			ix.fileMap["a"].SHA256 = hex.EncodeToString(make([]byte, 32))
+			assert.Equal(t, ErrChecksumMismatch, ix.GetFile("a", &bytes.Buffer{}, store, crypter))
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for _, name := range []string{"corrupted", "missing", "mismatched", "ok", "unhashed"} {
+		assert.Nil(t, ix.AddFile(newTestFile(name, testContents(4096)), store, store, crypter))
+	}
+	block := func(name string) string {
+		return ix.blockFilename(ix.fileMap[name].Blocks[0].Block)
+	}
+	store.files[block("corrupted")][100] ^= 1
+	store.Delete(block("missing"))
+	ix.fileMap["mismatched"].Size--
+	ix.fileMap["unhashed"].SHA256 = ""
+
+	results, err := ix.Verify(nil, store, crypter)
+	assert.Nil(t, err)
+	statuses := make(map[string]VerifyStatus)
+	for _, result := range results {
+		statuses[result.Filename] = result.Status
+		assert.Equal(t, result.Status == VerifyOK, result.Err == nil, result.Filename)
+	}
+	assert.Equal(t, map[string]VerifyStatus{
+		"corrupted":  VerifyCorrupted,
+		"missing":    VerifyMissing,
+		"mismatched": VerifyMismatched,
+		"ok":         VerifyOK,
+		"unhashed":   VerifyOK,
+	}, statuses)
+	assert.Equal(t, "corrupted", results[0].Filename)
+
+	results, err = ix.Verify([]string{"ok"}, store, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, []VerifyResult{{"ok", VerifyOK, nil}}, results)
+
+	_, err = ix.Verify([]string{"ok", "nope"}, store, crypter)
+	assert.NotNil(t, err)
+}
+
+// checkingStore is a testStore which counts the checks made for each file, and fails them with `err` if it's set
+type checkingStore struct {
+	*testStore
+	checks map[string]int
+	err    error
+}
+
+func (s *checkingStore) CheckExists(name string) (bool, error) {
+	s.checks[name]++
+	if s.err != nil {
+		return false, s.err
+	}
+	return s.testStore.Exists(name), nil
+}
+
+func TestVerifyChecksBlocksOnce(t *testing.T) {
+	ix, store, crypter := newTestIndex(t)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, ix.AddFile(newTestFile(fmt.Sprintf("file-%d", i), testContents(1000)), store, store, crypter))
+	}
+	checking := &checkingStore{testStore: store, checks: make(map[string]int)}
+	results, err := ix.Verify(nil, checking, crypter)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(results))
+	assert.Equal(t, len(ix.blocks), len(checking.checks))
+	for name, checks := range checking.checks {
+		assert.Equal(t, 1, checks, name)
+	}
+
+	// A store which can't be reached is an error, not a missing or corrupted file
+	checking.err = errors.New("connection refused")
+	results, err = ix.Verify(nil, checking, crypter)
+	assert.Equal(t, checking.err, err)
+	assert.Equal(t, 0, len(results))
+}
@@ -0,0 +1,512 @@
+package enstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WebDAVConfig configures a WebDAVReadWriter
+type WebDAVConfig struct {
+	// URL is the collection blocks and the index are stored in, such as "https://cloud.example.com/remote.php/dav/files/me/enstore"
+	URL string
+	// Username and Password are used for basic or digest authentication, whichever the server asks for
+	Username string
+	Password string
+	// HTTPClient is used to make requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// WebDAVReadWriter reads and writes blocks and the index as files in a WebDAV collection
+type WebDAVReadWriter struct {
+	config  WebDAVConfig
+	baseURL *url.URL
+	lock    sync.Mutex
+	auth    *webdavAuth
+}
+
+// WebDAVError is returned when the WebDAV server responds with an unexpected status
+type WebDAVError struct {
+	Method     string
+	Name       string
+	StatusCode int
+}
+
+func (e *WebDAVError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: unexpected status %d", e.Method, e.Name, e.StatusCode)
+}
+
+// NewWebDAVReadWriter creates a new WebDAVReadWriter
+func NewWebDAVReadWriter(cfg WebDAVConfig) (*WebDAVReadWriter, error) {
+	baseURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, errors.New("webdav: URL must be http or https")
+	}
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &WebDAVReadWriter{config: cfg, baseURL: baseURL}, nil
+}
+
+func (w *WebDAVReadWriter) Read(name string) ([]byte, error) {
+	return w.ReadContext(context.Background(), name)
+}
+
+// ReadContext downloads a file, cancelling the request if the context is done
+func (w *WebDAVReadWriter) ReadContext(ctx context.Context, name string) ([]byte, error) {
+	resp, err := w.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &WebDAVError{http.MethodGet, name, resp.StatusCode}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ReadRange reads `length` bytes of a file starting at `offset`. If the file ends first, the bytes read and io.EOF are returned.
+func (w *WebDAVReadWriter) ReadRange(name string, offset int64, length int) ([]byte, error) {
+	return w.ReadRangeContext(context.Background(), name, offset, length)
+}
+
+// ReadRangeContext is ReadRange, cancelling the request if the context is done
+func (w *WebDAVReadWriter) ReadRangeContext(ctx context.Context, name string, offset int64, length int) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	headers := http.Header{}
+	headers.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	resp, err := w.do(ctx, http.MethodGet, name, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		return []byte{}, io.EOF
+	case http.StatusPartialContent, http.StatusOK:
+	default:
+		return nil, &WebDAVError{http.MethodGet, name, resp.StatusCode}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// A server which ignores the Range header returns the whole file
+	if resp.StatusCode == http.StatusOK {
+		if offset >= int64(len(data)) {
+			return []byte{}, io.EOF
+		}
+		data = data[offset:]
+		if len(data) > length {
+			data = data[:length]
+		}
+	}
+	if len(data) < length {
+		return data, io.EOF
+	}
+	return data, nil
+}
+
+// Write uploads a file. If the collection doesn't exist yet, it is created.
+func (w *WebDAVReadWriter) Write(name string, data []byte) error {
+	return w.WriteContext(context.Background(), name, data)
+}
+
+// WriteContext is Write, cancelling the upload if the context is done
+func (w *WebDAVReadWriter) WriteContext(ctx context.Context, name string, data []byte) error {
+	return w.write(ctx, name, data, nil)
+}
+
+// ReadVersion downloads a file along with its ETag, or returns nil data if it doesn't exist
+func (w *WebDAVReadWriter) ReadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := w.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, "", nil
+	case http.StatusOK:
+	default:
+		return nil, "", &WebDAVError{http.MethodGet, name, resp.StatusCode}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// WriteIfVersion uploads a file only if its ETag is still `version` (with If-Match), or if `version` is "" only if it doesn't exist
+// (with If-None-Match), returning ErrWriteConflict otherwise
+func (w *WebDAVReadWriter) WriteIfVersion(ctx context.Context, name string, data []byte, version string) error {
+	headers := http.Header{}
+	if version == "" {
+		headers.Set("If-None-Match", "*")
+	} else {
+		headers.Set("If-Match", version)
+	}
+	err := w.write(ctx, name, data, headers)
+	if davErr, ok := err.(*WebDAVError); ok && davErr.StatusCode == http.StatusPreconditionFailed {
+		return ErrWriteConflict
+	}
+	return err
+}
+
+// write uploads a file with the headers, creating the collection if it doesn't exist yet
+func (w *WebDAVReadWriter) write(ctx context.Context, name string, data []byte, headers http.Header) error {
+	resp, err := w.do(ctx, http.MethodPut, name, headers, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Conflict (or Not Found, from some servers) means a parent collection is missing
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound {
+		if err := w.makeCollections(ctx); err != nil {
+			return err
+		}
+		resp, err = w.do(ctx, http.MethodPut, name, headers, data)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &WebDAVError{http.MethodPut, name, resp.StatusCode}
+	}
+	return nil
+}
+
+// Exists returns false if the file doesn't exist. If checking fails for any other reason, it's assumed to exist,
+// so reading it reports the error; use CheckExists to get the error instead.
+func (w *WebDAVReadWriter) Exists(name string) bool {
+	exists, err := w.CheckExists(name)
+	return exists || err != nil
+}
+
+// CheckExists returns true if the file exists, false if the server responds that it doesn't, or any other error checking for it
+func (w *WebDAVReadWriter) CheckExists(name string) (bool, error) {
+	resp, err := w.do(context.Background(), http.MethodHead, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return true, nil
+	}
+	return false, &WebDAVError{http.MethodHead, name, resp.StatusCode}
+}
+
+// Delete removes a file. Deleting a file which doesn't exist is not an error.
+func (w *WebDAVReadWriter) Delete(name string) error {
+	resp, err := w.do(context.Background(), http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || (resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return nil
+	}
+	return &WebDAVError{http.MethodDelete, name, resp.StatusCode}
+}
+
+// List returns the names of all files in the collection
+func (w *WebDAVReadWriter) List() ([]string, error) {
+	headers := http.Header{}
+	headers.Set("Depth", "1")
+	headers.Set("Content-Type", "application/xml")
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`)
+	resp, err := w.doURL(context.Background(), "PROPFIND", w.baseURL, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []string{}, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, &WebDAVError{"PROPFIND", w.baseURL.Path, resp.StatusCode}
+	}
+
+	var result webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result.Responses))
+	for _, response := range result.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the collection itself, and any collections inside it
+		if response.isCollection() || strings.TrimSuffix(href.Path, "/") == strings.TrimSuffix(w.baseURL.Path, "/") {
+			continue
+		}
+		names = append(names, path.Base(href.Path))
+	}
+	return names, nil
+}
+
+type webdavMultistatus struct {
+	Responses []webdavResponse `xml:"DAV: response"`
+}
+
+type webdavResponse struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Collection *struct{} `xml:"DAV: prop>resourcetype>collection"`
+	} `xml:"DAV: propstat"`
+}
+
+func (r *webdavResponse) isCollection() bool {
+	for _, propstat := range r.Propstats {
+		if propstat.Collection != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// makeCollections creates the collection at the base URL. If its parent is missing too (MKCOL responds Conflict),
+// parents are tried in turn until one can be created, and then the ones below it are, so nothing above the deepest collection
+// which exists is touched. Servers often refuse MKCOL on the collections above a user's files.
+func (w *WebDAVReadWriter) makeCollections(ctx context.Context) error {
+	missing := make([]string, 0)
+	collectionPath := w.baseURL.Path
+	for {
+		status, err := w.makeCollection(ctx, collectionPath)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusConflict {
+			break
+		}
+		missing = append(missing, collectionPath)
+		parent := path.Dir(strings.TrimSuffix(collectionPath, "/"))
+		if parent == "/" || parent == "." {
+			return &WebDAVError{"MKCOL", collectionPath, status}
+		}
+		collectionPath = parent + "/"
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		status, err := w.makeCollection(ctx, missing[i])
+		if err != nil {
+			return err
+		}
+		if status == http.StatusConflict {
+			return &WebDAVError{"MKCOL", missing[i], status}
+		}
+	}
+	return nil
+}
+
+// makeCollection creates a collection, returning Conflict if its parent doesn't exist.
+// Any other status than it being created, or already existing (Method Not Allowed), is an error.
+func (w *WebDAVReadWriter) makeCollection(ctx context.Context, collectionPath string) (int, error) {
+	collection := *w.baseURL
+	collection.Path = collectionPath
+	resp, err := w.doURL(ctx, "MKCOL", &collection, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed, http.StatusOK, http.StatusConflict:
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, &WebDAVError{"MKCOL", collectionPath, resp.StatusCode}
+}
+
+// do makes a request for a file in the collection
+func (w *WebDAVReadWriter) do(ctx context.Context, method, name string, headers http.Header, body []byte) (*http.Response, error) {
+	return w.doURL(ctx, method, w.baseURL.ResolveReference(&url.URL{Path: name}), headers, body)
+}
+
+// doURL makes an authenticated request. The first request is made without credentials, and the server's challenge
+// decides whether basic or digest authentication is used for it (and every following request).
+func (w *WebDAVReadWriter) doURL(ctx context.Context, method string, u *url.URL, headers http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range headers {
+			req.Header[key] = values
+		}
+
+		w.lock.Lock()
+		auth := w.auth
+		if auth != nil {
+			req.Header.Set("Authorization", auth.authorization(method, req.URL.RequestURI(), w.config.Username, w.config.Password))
+		}
+		w.lock.Unlock()
+
+		resp, err := w.config.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || w.config.Username == "" {
+			return resp, nil
+		}
+
+		// Authenticate according to the challenge and try again
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		newAuth, err := parseWebDAVChallenge(challenge)
+		if err != nil {
+			return nil, err
+		}
+		w.lock.Lock()
+		w.auth = newAuth
+		w.lock.Unlock()
+	}
+}
+
+// webdavAuth is the authentication scheme requested by the server
+type webdavAuth struct {
+	digest    bool
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	nc        int
+}
+
+// parseWebDAVChallenge parses a WWW-Authenticate header for the basic or digest scheme
+func parseWebDAVChallenge(header string) (*webdavAuth, error) {
+	scheme := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	switch strings.ToLower(scheme[0]) {
+	case "basic":
+		return &webdavAuth{}, nil
+	case "digest":
+		if len(scheme) < 2 {
+			return nil, errors.New("webdav: malformed digest challenge")
+		}
+		auth := &webdavAuth{digest: true, algorithm: "MD5"}
+		for _, param := range splitChallengeParams(scheme[1]) {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "realm":
+				auth.realm = value
+			case "nonce":
+				auth.nonce = value
+			case "opaque":
+				auth.opaque = value
+			case "algorithm":
+				auth.algorithm = value
+			case "qop":
+				// Prefer "auth" if the server offers a choice
+				for _, qop := range strings.Split(value, ",") {
+					if strings.TrimSpace(qop) == "auth" {
+						auth.qop = "auth"
+					}
+				}
+			}
+		}
+		if auth.nonce == "" {
+			return nil, errors.New("webdav: digest challenge has no nonce")
+		}
+		if auth.hash() == nil {
+			return nil, fmt.Errorf("webdav: unsupported digest algorithm %s", auth.algorithm)
+		}
+		return auth, nil
+	}
+	return nil, fmt.Errorf("webdav: unsupported authentication scheme %q", scheme[0])
+}
+
+// splitChallengeParams splits comma-separated challenge parameters, ignoring commas in quoted values
+func splitChallengeParams(s string) []string {
+	params := make([]string, 0)
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			params = append(params, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(params, s[start:])
+}
+
+func (a *webdavAuth) hash() func() hash.Hash {
+	switch strings.ToUpper(a.algorithm) {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// authorization returns the Authorization header value for a request. The lock must be held, as the nonce count is incremented.
+func (a *webdavAuth) authorization(method, uri, username, password string) string {
+	if !a.digest {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization")
+	}
+
+	newHash := a.hash()
+	h := func(s string) string {
+		hasher := newHash()
+		hasher.Write([]byte(s))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	ha1 := h(username + ":" + a.realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s`, username, a.realm, a.nonce, uri, a.algorithm)
+	if a.qop == "" {
+		header += fmt.Sprintf(`, response="%s"`, h(ha1+":"+a.nonce+":"+ha2))
+	} else {
+		a.nc++
+		nc := fmt.Sprintf("%08x", a.nc)
+		cnonceBytes := make([]byte, 8)
+		rand.Read(cnonceBytes)
+		cnonce := hex.EncodeToString(cnonceBytes)
+		response := h(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":" + a.qop + ":" + ha2)
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s", response="%s"`, a.qop, nc, cnonce, response)
+	}
+	if a.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, a.opaque)
+	}
+	return header
+}
@@ -0,0 +1,242 @@
+package enstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	testWebDAVUser     = "enstore"
+	testWebDAVPassword = "hunter2"
+	testWebDAVRealm    = "enstore test"
+	testWebDAVNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+func newTestWebDAVHandler() *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// conditionalPut refuses PUT requests whose If-Match or If-None-Match header doesn't hold, which webdav.Handler doesn't check
+func conditionalPut(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			head := httptest.NewRecorder()
+			handler.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.Path, nil))
+			exists := head.Code == http.StatusOK
+			match := r.Header.Get("If-Match")
+			if (match != "" && (!exists || match != head.Header().Get("ETag"))) || (r.Header.Get("If-None-Match") != "" && exists) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// basicAuth only passes requests with the test credentials through to the handler
+func basicAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != testWebDAVUser || password != testWebDAVPassword {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, testWebDAVRealm))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// digestAuth only passes requests with a valid digest (MD5, qop=auth) of the test credentials through to the handler
+func digestAuth(handler http.Handler) http.Handler {
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := make(map[string]string)
+		header := r.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Digest ") {
+			for _, param := range splitChallengeParams(strings.TrimPrefix(header, "Digest ")) {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 {
+					params[kv[0]] = strings.Trim(kv[1], "\"")
+				}
+			}
+		}
+		ha1 := h(testWebDAVUser + ":" + testWebDAVRealm + ":" + testWebDAVPassword)
+		ha2 := h(r.Method + ":" + params["uri"])
+		expected := h(ha1 + ":" + testWebDAVNonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["username"] != testWebDAVUser || params["uri"] != r.URL.RequestURI() || params["response"] != expected {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth,auth-int", nonce="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`, testWebDAVRealm, testWebDAVNonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func TestWebDAVReadWriter(t *testing.T) {
+	for name, auth := range map[string]func(http.Handler) http.Handler{"basic": basicAuth, "digest": digestAuth} {
+		t.Run(name, func(t *testing.T) {
+			handler := newTestWebDAVHandler()
+			server := httptest.NewServer(auth(handler))
+			defer server.Close()
+
+			w, err := NewWebDAVReadWriter(WebDAVConfig{
+				URL:      server.URL + "/stores/enstore",
+				Username: testWebDAVUser,
+				Password: testWebDAVPassword,
+			})
+			assert.Nil(t, err)
+
+			assert.False(t, w.Exists("block"))
+			_, err = w.Read("block")
+			assert.Equal(t, &WebDAVError{http.MethodGet, "block", http.StatusNotFound}, err)
+
+			// The collection doesn't exist yet, so it (and its parent) are created by the first write
+			contents := testContents(1000)
+			assert.Nil(t, w.Write("block", contents))
+			info, err := handler.FileSystem.Stat(context.Background(), "/stores/enstore/block")
+			if assert.Nil(t, err) {
+				assert.Equal(t, int64(1000), info.Size())
+			}
+
+			assert.True(t, w.Exists("block"))
+			data, err := w.Read("block")
+			assert.Nil(t, err)
+			assert.Equal(t, contents, data)
+
+			data, err = w.ReadRange("block", 100, 50)
+			assert.Nil(t, err)
+			assert.Equal(t, contents[100:150], data)
+			data, err = w.ReadRange("block", 990, 50)
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, contents[990:], data)
+
+			assert.Nil(t, w.Delete("block"))
+			assert.False(t, w.Exists("block"))
+			assert.Nil(t, w.Delete("block"))
+		})
+	}
+}
+
+func TestWebDAVReadWriterMakeCollections(t *testing.T) {
+	handler := newTestWebDAVHandler()
+	assert.Nil(t, handler.FileSystem.Mkdir(context.Background(), "/remote.php", 0755))
+	assert.Nil(t, handler.FileSystem.Mkdir(context.Background(), "/remote.php/dav", 0755))
+	assert.Nil(t, handler.FileSystem.Mkdir(context.Background(), "/remote.php/dav/files", 0755))
+	mkcols := make([]string, 0)
+	// Like Nextcloud, MKCOL is refused outside the user's files
+	server := httptest.NewServer(basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "MKCOL" {
+			if !strings.HasPrefix(r.URL.Path, "/remote.php/dav/files/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			mkcols = append(mkcols, r.URL.Path)
+		}
+		handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	w, err := NewWebDAVReadWriter(WebDAVConfig{
+		URL:      server.URL + "/remote.php/dav/files/me/enstore",
+		Username: testWebDAVUser,
+		Password: testWebDAVPassword,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write("block", testContents(10)))
+	assert.Equal(t, []string{"/remote.php/dav/files/me/enstore/", "/remote.php/dav/files/me/", "/remote.php/dav/files/me/enstore/"}, mkcols)
+
+	// Errors other than the file not existing are reported, not mistaken for it missing
+	broken, err := NewWebDAVReadWriter(WebDAVConfig{URL: server.URL + "/remote.php/dav/files/me/enstore"})
+	assert.Nil(t, err)
+	exists, err := broken.CheckExists("block")
+	assert.False(t, exists)
+	assert.Equal(t, &WebDAVError{http.MethodHead, "block", http.StatusUnauthorized}, err)
+	assert.True(t, broken.Exists("block"))
+	exists, err = w.CheckExists("missing")
+	assert.False(t, exists)
+	assert.Nil(t, err)
+}
+
+func TestWebDAVReadWriterDeleteList(t *testing.T) {
+	handler := newTestWebDAVHandler()
+	server := httptest.NewServer(basicAuth(handler))
+	defer server.Close()
+	w, _ := NewWebDAVReadWriter(WebDAVConfig{
+		URL:      server.URL + "/enstore",
+		Username: testWebDAVUser,
+		Password: testWebDAVPassword,
+	})
+
+	// Nothing to list before the collection exists
+	names, err := w.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	// Collections inside the collection aren't listed
+	assert.Nil(t, handler.FileSystem.Mkdir(context.Background(), "/enstore", 0755))
+	assert.Nil(t, handler.FileSystem.Mkdir(context.Background(), "/enstore/nested", 0755))
+
+	testDeleteList(t, w)
+}
+
+func TestWebDAVReadWriterConditionalWrite(t *testing.T) {
+	server := httptest.NewServer(basicAuth(conditionalPut(newTestWebDAVHandler())))
+	defer server.Close()
+	w, _ := NewWebDAVReadWriter(WebDAVConfig{
+		URL:      server.URL + "/enstore",
+		Username: testWebDAVUser,
+		Password: testWebDAVPassword,
+	})
+	testConditionalWrite(t, w)
+}
+
+func TestWebDAVReadWriterBadCredentials(t *testing.T) {
+	server := httptest.NewServer(digestAuth(newTestWebDAVHandler()))
+	defer server.Close()
+
+	w, err := NewWebDAVReadWriter(WebDAVConfig{
+		URL:      server.URL,
+		Username: testWebDAVUser,
+		Password: "wrong",
+	})
+	assert.Nil(t, err)
+	err = w.Write("index", []byte("index"))
+	assert.Equal(t, &WebDAVError{http.MethodPut, "index", http.StatusUnauthorized}, err)
+}
+
+func TestWebDAVReadWriterIndex(t *testing.T) {
+	server := httptest.NewServer(basicAuth(conditionalPut(newTestWebDAVHandler())))
+	defer server.Close()
+	w, _ := NewWebDAVReadWriter(WebDAVConfig{
+		URL:      server.URL + "/enstore/",
+		Username: testWebDAVUser,
+		Password: testWebDAVPassword,
+	})
+	ix, _, crypter := newTestIndex(t)
+
+	contents := testContents(10000)
+	assert.Nil(t, ix.AddFile(newTestFile("file", contents), w, w, crypter))
+	assert.Nil(t, ix.Save(w, crypter))
+
+	loaded, err := LoadIndex(w, crypter, ix.config)
+	assert.Nil(t, err)
+	buf := &strings.Builder{}
+	assert.Nil(t, loaded.GetFile("file", buf, w, crypter))
+	assert.Equal(t, string(contents), buf.String())
+}